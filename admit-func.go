@@ -1,26 +1,64 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	admv1 "k8s.io/api/admission/v1"
+	admv1beta1 "k8s.io/api/admission/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 )
 
-func writeErr(err error, w io.Writer) {
-	lg.WithError(err).Error("writing error response")
-	json.NewEncoder(w).Encode(admv1.AdmissionResponse{
+// writeErr answers a request which could not be handled with the status code
+// and an AdmissionReview describing the error, in the review's version and for
+// its UID once they are known. The API server treats any status but 200 as a
+// failed call, so the webhook's failurePolicy applies.
+func writeErr(lg logrus.FieldLogger, code int, gv schema.GroupVersion, uid types.UID, err error, w http.ResponseWriter) {
+	lg.WithError(err).WithField("code", code).Error("writing error response")
+	res := &admv1.AdmissionResponse{
+		UID: uid,
 		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    int32(code),
 			Message: err.Error(),
 		},
-	})
+	}
+	tm := metav1.TypeMeta{
+		APIVersion: gv.String(),
+		Kind:       "AdmissionReview",
+	}
+	var out interface{} = admv1.AdmissionReview{
+		TypeMeta: tm,
+		Response: res,
+	}
+	if gv == admv1beta1.SchemeGroupVersion {
+		out = admv1beta1.AdmissionReview{
+			TypeMeta: tm,
+			Response: responseToV1beta1(res),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(out)
 }
 
 var (
@@ -28,46 +66,365 @@ var (
 	codecs = serializer.NewCodecFactory(scheme)
 )
 
-type admitFunc func(admv1.AdmissionReview) (*admv1.AdmissionResponse, error)
+func init() {
+	utilruntime.Must(admv1.AddToScheme(scheme))
+	utilruntime.Must(admv1beta1.AddToScheme(scheme))
+}
+
+// admissionReasonKey is the context key of the *string a handler sets to why
+// it decided as it did.
+type admissionReasonKey struct{}
+
+// setReason records why the admission was decided as it was, for
+// ca_injector_admission_requests_total. skipped marks requests the handler
+// did not look at. Reasons must be fixed strings to keep the metric's
+// cardinality bounded.
+func setReason(ctx context.Context, reason string, skipped bool) {
+	if d, ok := ctx.Value(admissionReasonKey{}).(*admissionDecision); ok {
+		d.reason, d.skipped = reason, skipped
+	}
+}
 
-func (a admitFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+type admissionDecision struct {
+	reason  string
+	skipped bool
+}
+
+// decision returns the decision label for the response.
+func (d admissionDecision) decision(res *admv1.AdmissionResponse, err error) (string, string) {
+	switch {
+	case err != nil:
+		return "errored", "error"
+	case !res.Allowed:
+		return "denied", first(d.reason, "error")
+	case res.Patch != nil:
+		return "patched", first(d.reason, "injected")
+	case d.skipped:
+		return "skipped", d.reason
+	}
+	return "allowed", first(d.reason, "none")
+}
+
+// admitFunc handles an admission review. It always sees an
+// admission.k8s.io/v1 review; v1beta1 reviews are converted on the way in and
+// the response is converted back. ctx carries the admission's span.
+type admitFunc func(context.Context, admv1.AdmissionReview) (*admv1.AdmissionResponse, error)
+
+// admitHandler serves an admitFunc over HTTP. The handler's context expires
+// a margin before the API server gives up on the request, at which point a
+// response is sent without waiting for the handler any longer.
+type admitHandler struct {
+	admit admitFunc
+	// defaultTimeout applies when the API server does not send one.
+	defaultTimeout time.Duration
+	margin         time.Duration
+	// denyOnTimeout denies rather than allows requests which time out.
+	denyOnTimeout bool
+	// maxBodyBytes limits the size of a review; unlimited if zero.
+	maxBodyBytes int64
+	// slots bounds how many handlers run at once, shared by the handlers
+	// serving reviews; unbounded if nil. A review waits up to queueTimeout
+	// for a slot, and is then allowed without the handler, or answered with
+	// an error if errorOnOverload is set.
+	slots           chan struct{}
+	queueTimeout    time.Duration
+	errorOnOverload bool
+	// auditSkips records the reason of reviews which were not patched as an
+	// audit annotation.
+	auditSkips bool
+}
+
+// with returns the handler serving admit.
+func (h admitHandler) with(admit admitFunc) admitHandler {
+	h.admit = admit
+	return h
+}
+
+// deadline returns how long the handler may take for the request, from the
+// timeout the API server passes in the query.
+func (h admitHandler) deadline(r *http.Request) time.Duration {
+	timeout := h.defaultTimeout
+	if t, err := time.ParseDuration(r.URL.Query().Get("timeout")); err == nil && t > 0 {
+		timeout = t
+	}
+	if timeout <= h.margin {
+		return timeout / 2
+	}
+	return timeout - h.margin
+}
+
+func (h admitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lg := requestLogger(r.Context())
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "admission", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	// Every request is counted once; those failing before the handler runs
+	// have no operation.
+	operation, decision, reason := "", "errored", "decode_error"
+	defer func() {
+		ctrAdmissionRequests.WithLabelValues(operation, decision, reason).Inc()
+	}()
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeErr(lg, http.StatusMethodNotAllowed, admv1.SchemeGroupVersion, "", fmt.Errorf("method %s not allowed", r.Method), w)
+		return
+	}
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+		writeErr(lg, http.StatusUnsupportedMediaType, admv1.SchemeGroupVersion, "", fmt.Errorf("content type %q is not application/json", r.Header.Get("Content-Type")), w)
+		return
+	}
 	if r.Body == nil {
-		writeErr(fmt.Errorf("no body"), w)
+		writeErr(lg, http.StatusBadRequest, admv1.SchemeGroupVersion, "", fmt.Errorf("no body"), w)
 		return
 	}
 	defer r.Body.Close()
 
-	bs, err := ioutil.ReadAll(r.Body)
+	body := io.Reader(r.Body)
+	if h.maxBodyBytes > 0 {
+		body = http.MaxBytesReader(w, r.Body, h.maxBodyBytes)
+	}
+	bs, err := ioutil.ReadAll(body)
 	if err != nil {
-		writeErr(err, w)
+		code := http.StatusBadRequest
+		if h.maxBodyBytes > 0 && strings.Contains(err.Error(), "request body too large") {
+			code = http.StatusRequestEntityTooLarge
+			err = fmt.Errorf("admission review larger than %d bytes", h.maxBodyBytes)
+		}
+		writeErr(lg, code, admv1.SchemeGroupVersion, "", err, w)
 		return
 	}
 
-	var ar admv1.AdmissionReview
-	_, _, err = codecs.UniversalDeserializer().Decode(bs, nil, &ar)
+	_, decodeSpan := tracer.Start(ctx, "decode review")
+	obj, gvk, err := codecs.UniversalDeserializer().Decode(bs, nil, nil)
+	decodeSpan.End()
 	if err != nil {
-		writeErr(err, w)
+		ctrDecodeErrors.WithLabelValues("review").Inc()
+		writeErr(lg, http.StatusBadRequest, admv1.SchemeGroupVersion, "", fmt.Errorf("error decoding admission review: %w", err), w)
 		return
 	}
 
-	res, err := a(ar)
+	var ar admv1.AdmissionReview
+	switch in := obj.(type) {
+	case *admv1.AdmissionReview:
+		ar = *in
+	case *admv1beta1.AdmissionReview:
+		ar = admv1.AdmissionReview{
+			TypeMeta: in.TypeMeta,
+			Request:  requestFromV1beta1(in.Request),
+		}
+	default:
+		ctrDecodeErrors.WithLabelValues("review").Inc()
+		writeErr(lg, http.StatusBadRequest, admv1.SchemeGroupVersion, "", fmt.Errorf("unsupported admission review type %s", gvk), w)
+		return
+	}
+
+	if ar.Request == nil {
+		writeErr(lg, http.StatusBadRequest, gvk.GroupVersion(), "", fmt.Errorf("admission review has no request"), w)
+		return
+	}
+
+	lg = lg.WithField("uid", ar.Request.UID)
+	operation = string(ar.Request.Operation)
+	span.SetAttributes(
+		attribute.String("admission.uid", string(ar.Request.UID)),
+		attribute.String("admission.namespace", ar.Request.Namespace),
+		attribute.String("admission.operation", string(ar.Request.Operation)),
+		attribute.String("admission.kind", ar.Request.Kind.Kind),
+	)
+
+	ctx, cancel := context.WithTimeout(withLogger(ctx, lg), h.deadline(r))
+	defer cancel()
+
+	if !h.acquire(ctx) {
+		ctrAdmissionShed.Inc()
+		reason = "overloaded"
+		if h.errorOnOverload {
+			writeErr(lg, http.StatusServiceUnavailable, gvk.GroupVersion(), ar.Request.UID, fmt.Errorf("too many admissions in flight"), w)
+			return
+		}
+		lg.Warn("too many admissions in flight; allowing without the CA")
+		decision = "allowed"
+		res := &admv1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: []string{"ca-injector is overloaded; the CA was not injected"},
+		}
+		h.auditSkipped(res, reason)
+		h.respond(lg, w, gvk, ar, res)
+		return
+	}
+
+	type result struct {
+		res *admv1.AdmissionResponse
+		err error
+	}
+	done := make(chan result, 1)
+	d := &admissionDecision{}
+	go func() {
+		// The slot is held until the handler returns, even if the API server
+		// was answered without it, so abandoned handlers count too.
+		defer h.release()
+		gaugeAdmissionsInFlight.Inc()
+		defer gaugeAdmissionsInFlight.Dec()
+		res, err := h.admit(context.WithValue(ctx, admissionReasonKey{}, d), ar)
+		done <- result{res, err}
+	}()
+
+	var res *admv1.AdmissionResponse
+	select {
+	case out := <-done:
+		res, err = out.res, out.err
+		if res != nil && emptyPatch(res.Patch) {
+			// A bare response keeps the API server from reporting the
+			// object as modified and reinvoking other webhooks.
+			res.Patch, res.PatchType = nil, nil
+		}
+		decision, reason = d.decision(res, err)
+	case <-ctx.Done():
+		// The handler keeps running until its API calls notice the
+		// cancellation, but the API server gets an answer in time.
+		lg.Warn("admission timed out")
+		ctrAdmissionTimeouts.Inc()
+		res, err = h.timeoutResponse(), nil
+		decision, reason = "allowed", "timeout"
+		if h.denyOnTimeout {
+			decision = "denied"
+		}
+	}
 	if err != nil {
-		writeErr(err, w)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		writeErr(lg, http.StatusInternalServerError, gvk.GroupVersion(), ar.Request.UID, err, w)
 		return
 	}
+	span.SetAttributes(
+		attribute.Bool("admission.allowed", res.Allowed),
+		attribute.Bool("admission.patched", res.Patch != nil),
+	)
+
+	h.auditSkipped(res, reason)
+	h.respond(lg, w, gvk, ar, res)
+}
 
-	if ar.Request != nil {
-		res.UID = ar.Request.UID
+// respond writes the response to the review, in the version it was sent in.
+func (h admitHandler) respond(lg logrus.FieldLogger, w http.ResponseWriter, gvk *schema.GroupVersionKind, ar admv1.AdmissionReview, res *admv1.AdmissionResponse) {
+	res.UID = ar.Request.UID
+
+	tm := metav1.TypeMeta{
+		APIVersion: gvk.GroupVersion().String(),
+		Kind:       gvk.Kind,
 	}
-	ar = admv1.AdmissionReview{
-		TypeMeta: ar.TypeMeta,
+	var out interface{} = admv1.AdmissionReview{
+		TypeMeta: tm,
 		Response: res,
 	}
+	if gvk.GroupVersion() == admv1beta1.SchemeGroupVersion {
+		out = admv1beta1.AdmissionReview{
+			TypeMeta: tm,
+			Response: responseToV1beta1(res),
+		}
+	}
 
-	lg.WithField("res", ar).Info("writing response")
+	lg.WithField("res", out).Debug("writing response")
 
-	err = json.NewEncoder(w).Encode(ar)
+	err := json.NewEncoder(w).Encode(out)
 	if err != nil {
 		logrus.WithError(err).Error("could not serialize admissionreview")
 	}
 }
+
+// emptyPatch reports whether the JSON patch holds no operations.
+func emptyPatch(bs []byte) bool {
+	var ops []json.RawMessage
+	return len(bytes.TrimSpace(bs)) == 0 || json.Unmarshal(bs, &ops) == nil && len(ops) == 0
+}
+
+// acquire takes a slot for running the handler, waiting up to queueTimeout
+// for one. It reports false if none freed up in time.
+func (h admitHandler) acquire(ctx context.Context) bool {
+	if h.slots == nil {
+		return true
+	}
+	if h.queueTimeout <= 0 {
+		select {
+		case h.slots <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+	t := time.NewTimer(h.queueTimeout)
+	defer t.Stop()
+	select {
+	case h.slots <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (h admitHandler) release() {
+	if h.slots != nil {
+		<-h.slots
+	}
+}
+
+func requestFromV1beta1(in *admv1beta1.AdmissionRequest) *admv1.AdmissionRequest {
+	if in == nil {
+		return nil
+	}
+	return &admv1.AdmissionRequest{
+		UID:                in.UID,
+		Kind:               in.Kind,
+		Resource:           in.Resource,
+		SubResource:        in.SubResource,
+		RequestKind:        in.RequestKind,
+		RequestResource:    in.RequestResource,
+		RequestSubResource: in.RequestSubResource,
+		Name:               in.Name,
+		Namespace:          in.Namespace,
+		Operation:          admv1.Operation(in.Operation),
+		UserInfo:           in.UserInfo,
+		Object:             in.Object,
+		OldObject:          in.OldObject,
+		DryRun:             in.DryRun,
+		Options:            in.Options,
+	}
+}
+
+func responseToV1beta1(in *admv1.AdmissionResponse) *admv1beta1.AdmissionResponse {
+	out := &admv1beta1.AdmissionResponse{
+		UID:              in.UID,
+		Allowed:          in.Allowed,
+		Result:           in.Result,
+		Patch:            in.Patch,
+		AuditAnnotations: in.AuditAnnotations,
+		Warnings:         in.Warnings,
+	}
+	if in.PatchType != nil {
+		pt := admv1beta1.PatchType(*in.PatchType)
+		out.PatchType = &pt
+	}
+	return out
+}
+
+func (h admitHandler) timeoutResponse() *admv1.AdmissionResponse {
+	if h.denyOnTimeout {
+		return &admv1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Reason:  metav1.StatusReasonTimeout,
+				Code:    http.StatusGatewayTimeout,
+				Message: "ca-injector: timed out injecting the CA",
+			},
+		}
+	}
+	return &admv1.AdmissionResponse{
+		Allowed:  true,
+		Warnings: []string{"ca-injector timed out; the CA was not injected"},
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	admv1 "k8s.io/api/admission/v1"
+	admv1beta1 "k8s.io/api/admission/v1beta1"
+)
+
+// allowAll admits everything unchanged.
+func allowAll(context.Context, admv1.AdmissionReview) (*admv1.AdmissionResponse, error) {
+	return &admv1.AdmissionResponse{Allowed: true}, nil
+}
+
+func TestServeHTTPRejects(t *testing.T) {
+	review, err := json.Marshal(podReview(t, testPod("web", nil), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        []byte
+		code        int
+	}{
+		{name: "not a post", method: http.MethodGet, contentType: "application/json", body: review, code: http.StatusMethodNotAllowed},
+		{name: "not json", method: http.MethodPost, contentType: "text/plain", body: review, code: http.StatusUnsupportedMediaType},
+		{name: "no content type", method: http.MethodPost, body: review, code: http.StatusUnsupportedMediaType},
+		{name: "too large", method: http.MethodPost, contentType: "application/json", body: append(review, bytes.Repeat([]byte(" "), 1<<10)...), code: http.StatusRequestEntityTooLarge},
+		{name: "truncated", method: http.MethodPost, contentType: "application/json", body: review[:len(review)/2], code: http.StatusBadRequest},
+		{name: "no request", method: http.MethodPost, contentType: "application/json", body: []byte(`{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview"}`), code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := admitHandler{defaultTimeout: 10 * time.Second, maxBodyBytes: int64(len(review))}.with(allowAll)
+			r := httptest.NewRequest(tt.method, "/pods", bytes.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.code {
+				t.Errorf("status %d, want %d", w.Code, tt.code)
+			}
+			var out admv1.AdmissionReview
+			if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+				t.Fatalf("body is not a review: %s", w.Body)
+			}
+			if out.Response == nil || out.Response.Result == nil || int(out.Response.Result.Code) != tt.code {
+				t.Errorf("want a review with the error, got %s", w.Body)
+			}
+			if out.Kind != "AdmissionReview" || !strings.HasPrefix(out.APIVersion, "admission.k8s.io/") {
+				t.Errorf("review type %s", out.TypeMeta)
+			}
+		})
+	}
+}
+
+func TestServeHTTPEchoesUID(t *testing.T) {
+	pods, _ := newTestAdmitter(t, newConfig(), testSecret("team", "corp-ca"))
+	full := make(chan struct{}, 1)
+	full <- struct{}{}
+
+	tests := []struct {
+		name    string
+		h       http.Handler
+		beta    bool
+		dryRun  bool
+		code    int
+		patched bool
+	}{
+		{name: "allowed", h: admitHandler{defaultTimeout: time.Second}.with(allowAll), code: http.StatusOK},
+		{name: "v1beta1", h: admitHandler{defaultTimeout: time.Second}.with(allowAll), beta: true, code: http.StatusOK},
+		{name: "patched", h: pods, code: http.StatusOK, patched: true},
+		{name: "dry run", h: pods, dryRun: true, code: http.StatusOK, patched: true},
+		{name: "errored", h: admitHandler{defaultTimeout: time.Second}.with(func(context.Context, admv1.AdmissionReview) (*admv1.AdmissionResponse, error) {
+			return nil, errors.New("broken")
+		}), code: http.StatusInternalServerError},
+		{name: "timed out", h: admitHandler{defaultTimeout: 10 * time.Millisecond}.with(func(ctx context.Context, _ admv1.AdmissionReview) (*admv1.AdmissionResponse, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}), code: http.StatusOK},
+		{name: "overloaded", h: admitHandler{defaultTimeout: time.Second, slots: full}.with(allowAll), code: http.StatusOK},
+		{name: "overloaded with errors", h: admitHandler{defaultTimeout: time.Second, slots: full, errorOnOverload: true}.with(allowAll), code: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ar := podReview(t, testPod("web", map[string]string{label: "corp-ca"}), nil)
+			ar.Request.DryRun = &tt.dryRun
+			if tt.beta {
+				ar.APIVersion = admv1beta1.SchemeGroupVersion.String()
+			}
+			body, err := json.Marshal(ar)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := post(tt.h, body)
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+			var out admv1.AdmissionReview
+			if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil || out.Response == nil {
+				t.Fatalf("body is not a review: %s", w.Body)
+			}
+			if out.Response.UID != ar.Request.UID {
+				t.Errorf("uid %q, want %q", out.Response.UID, ar.Request.UID)
+			}
+			if out.APIVersion != ar.APIVersion {
+				t.Errorf("apiVersion %q, want %q", out.APIVersion, ar.APIVersion)
+			}
+			if patched := out.Response.Patch != nil; patched != tt.patched {
+				t.Errorf("patched = %v, want %v", patched, tt.patched)
+			}
+		})
+	}
+}
+
+func TestServeHTTPDropsEmptyPatches(t *testing.T) {
+	for _, patch := range []string{"", "[]", " [ ] ", "null"} {
+		h := admitHandler{defaultTimeout: time.Second}.with(func(context.Context, admv1.AdmissionReview) (*admv1.AdmissionResponse, error) {
+			pt := admv1.PatchTypeJSONPatch
+			return &admv1.AdmissionResponse{Allowed: true, Patch: []byte(patch), PatchType: &pt}, nil
+		})
+		res := admit(t, h, podReview(t, testPod("web", nil), nil))
+		if res.Patch != nil || res.PatchType != nil {
+			t.Errorf("patch %q: got %q of type %v", patch, res.Patch, res.PatchType)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	admv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+
+	"github.com/microcumulus/ca-injector/mutate"
+)
+
+// admitPods returns the handler for /pods, which injects the CA into pods as
+// they are created and into the ephemeral containers updates add to them. It
+// writes the secrets the injected volume needs unless the review is a dry run
+// or the injector audits. issuers and bundles may be nil.
+func admitPods(cfg *viper.Viper, cs kubernetes.Interface, secrets corelisters.SecretLister, issuers *issuerResolver, bundles *bundleResolver, ownNs string) admitFunc {
+	return func(ctx context.Context, ar admv1.AdmissionReview) (res *admv1.AdmissionResponse, err error) {
+		cfg := settings(cfg)
+		lg := requestLogger(ctx)
+		// Dry runs change nothing, so they are left out of the metrics of
+		// injections and skips.
+		dryRun := ar.Request.DryRun != nil && *ar.Request.DryRun
+		if dryRun {
+			lg = lg.WithField("dryRun", true)
+		}
+		start := time.Now()
+		defer func() {
+			if dryRun {
+				return
+			}
+			outcome := "allowed"
+			switch {
+			case err != nil:
+				outcome = "errored"
+			case !res.Allowed:
+				outcome = "denied"
+			case res.Patch != nil:
+				outcome = "patched"
+			}
+			histAdmission.WithLabelValues(outcome).Observe(secsSince(start))
+		}()
+
+		// The webhook may be routed more than it handles; let anything else
+		// through untouched rather than failing to decode it.
+		if k := ar.Request.Kind; k.Group != "" || k.Kind != "Pod" {
+			lg.WithField("kind", k.String()).Warn("allowing unsupported kind; check the webhook rules")
+			setReason(ctx, "unsupported_kind", true)
+			return &admv1.AdmissionResponse{
+				Allowed:  true,
+				Warnings: []string{fmt.Sprintf("ca-injector only handles pods; %s was allowed unchanged", k.Kind)},
+			}, nil
+		}
+		update := ar.Request.Operation == admv1.Update
+		switch {
+		case ar.Request.Operation == admv1.Create && ar.Request.SubResource == "":
+		case update && (ar.Request.SubResource == "" || ar.Request.SubResource == "ephemeralcontainers"):
+		default:
+			lg.WithField("operation", ar.Request.Operation).Debug("allowing operation untouched")
+			setReason(ctx, "unsupported_operation", true)
+			return &admv1.AdmissionResponse{Allowed: true}, nil
+		}
+
+		if namespaceExcluded(cfg, ownNs, ar.Request.Namespace) {
+			lg.WithField("namespace", ar.Request.Namespace).Debug("allowing pod in excluded namespace")
+			if !dryRun {
+				ctrPodsSkipped.WithLabelValues("excluded_namespace").Inc()
+			}
+			setReason(ctx, "excluded_namespace", true)
+			return &admv1.AdmissionResponse{Allowed: true}, nil
+		}
+
+		var pod, oldPod corev1.Pod
+		_, decodeSpan := tracer.Start(ctx, "decode pod")
+		obj, _, err := codecs.UniversalDeserializer().Decode(ar.Request.Object.Raw, nil, &pod)
+		if err == nil && update {
+			_, _, err = codecs.UniversalDeserializer().Decode(ar.Request.OldObject.Raw, nil, &oldPod)
+		}
+		decodeSpan.End()
+		if err != nil {
+			ctrDecodeErrors.WithLabelValues("object").Inc()
+			if !dryRun {
+				ctrPodsSkipped.WithLabelValues("decode_error").Inc()
+			}
+			lg.WithError(err).Error("could not deserialize pod spec")
+			return nil, err
+		}
+
+		if pod.Namespace == "" {
+			pod.Namespace = ar.Request.Namespace
+		}
+
+		lg = lg.WithFields(logrus.Fields{
+			"ar.Request.Name":                        ar.Request.Name,
+			"ar.Request.Namespace":                   ar.Request.Namespace,
+			"pod.Name":                               pod.Name,
+			"pod.Namespace":                          pod.Namespace,
+			"pod.CreationTimestamp":                  pod.CreationTimestamp.Time,
+			"obj.GetObjectKind().GroupVersionKind()": obj.GetObjectKind().GroupVersionKind(),
+		})
+
+		// Updates only ever patch the ephemeral containers they add; any other
+		// update is let through before its CA is even looked at.
+		if update && !mutate.AddsEphemeralContainers(oldPod, pod) {
+			lg.Debug("allowing update which adds no ephemeral containers")
+			setReason(ctx, "no_new_containers", true)
+			return &admv1.AdmissionResponse{Allowed: true}, nil
+		}
+
+		// The template's injection wins, even if the settings have changed
+		// since; the workload is patched again on its next update.
+		if !update && mutate.FromTemplate(pod) {
+			skipPod(ctx, lg, "already_injected", dryRun)
+			return &admv1.AdmissionResponse{Allowed: true}, nil
+		}
+
+		secret, source := resolveSecret(cfg, pod)
+		bundle := bundleFor(cfg, pod)
+		cm := policyConfigMap(cfg, pod)
+		if secret == "" && bundle == "" && cm == "" {
+			res := &admv1.AdmissionResponse{
+				Allowed: true,
+			}
+			if optedOut(pod) {
+				skipPod(ctx, lg, "optout", dryRun)
+				return res, nil
+			}
+			if ref := disallowedSecret(cfg, pod); ref != "" {
+				lg.WithFields(logrus.Fields{
+					"secret": ref,
+					"user":   ar.Request.UserInfo.Username,
+				}).Warn("pod references a secret not allowed by SECRET_NAME_PATTERN")
+				if !dryRun {
+					ctrSecretDisallowed.WithLabelValues(ar.Request.Namespace).Inc()
+				}
+				skipPod(ctx, lg, "secret_disallowed", dryRun)
+				msg := fmt.Sprintf("ca-injector may not inject secret %q, which does not match SECRET_NAME_PATTERN", ref)
+				if cfg.GetString("secret.name.policy") == "deny" {
+					return &admv1.AdmissionResponse{
+						Allowed: false,
+						Result: &metav1.Status{
+							Status:  metav1.StatusFailure,
+							Reason:  metav1.StatusReasonForbidden,
+							Code:    http.StatusForbidden,
+							Message: msg,
+						},
+					}, nil
+				}
+				res.Warnings = []string{msg + "; nothing was injected"}
+				return res, nil
+			}
+			skipPod(ctx, lg, "no_annotation", dryRun)
+			switch ref := requestedSecret(pod); {
+			case ref == "true":
+				lg.Warn("pod requests the default CA secret but neither its namespace nor DEFAULT_CA_SECRET sets one")
+				res.Warnings = []string{"ca-injector has no default CA secret configured for this namespace; nothing was injected"}
+			case ref != "":
+				lg.WithField("secret", ref).Warn("pod references a secret in a namespace not allowed by SECRET_SOURCE_NAMESPACES")
+				res.Warnings = []string{fmt.Sprintf("ca-injector may not copy secret %q into this namespace; nothing was injected", ref)}
+			}
+			return res, nil
+		}
+		lg = lg.WithField("secretSource", source)
+		if skipsWindows(cfg, pod) {
+			lg.Warn("not injecting the CA into a Windows pod")
+			skipPod(ctx, lg, "windows", dryRun)
+			return &admv1.AdmissionResponse{
+				Allowed:  true,
+				Warnings: []string{"ca-injector does not inject the CA into Windows pods unless WINDOWS_POLICY=inject; nothing was injected"},
+			}, nil
+		}
+		if update && !mutate.Injected(pod, mutateConfig(cfg, bundles, pod)) {
+			// Without the CA volume there is nothing to mount into the new
+			// containers, and nothing to sync it for.
+			skipPod(ctx, lg, "not_injected", dryRun)
+			return &admv1.AdmissionResponse{Allowed: true}, nil
+		}
+		lg.Debug("will patch")
+
+		warnings := annotationWarnings(pod)
+		if windowsPod(pod) && annotation(pod.Annotations, modeLabel) == "merge" {
+			warnings = append(warnings, "merge mode needs a Linux init container; the CA is mounted on its own in this Windows pod")
+		}
+		if keys := legacyKeys(pod); len(keys) > 0 {
+			lg.WithField("keys", keys).Warn("pod uses the deprecated annotation prefix " + legacyPrefix)
+		}
+		if _, err := defaultMode(cfg, pod); err != nil {
+			warnings = append(warnings, err.Error())
+		}
+		if _, err := secretKey(cfg, pod); err != nil {
+			warnings = append(warnings, err.Error())
+		}
+		srcNs, srcName := splitSecretRef(pod.Namespace, secret)
+		issuer := issuerFor(cfg, pod)
+		inline := usesInline(secret, pod)
+		var (
+			secretErr  error
+			inlineData []byte
+		)
+		_, lookupSpan := tracer.Start(ctx, "secret lookup")
+		if cm != "" {
+			secretErr = policies.checkConfigMap(pod.Namespace, policyFor(cfg, pod))
+		} else if bundle != "" {
+			// Without the Bundle there is no telling what to mount.
+			if _, err := bundles.target(bundle); err != nil {
+				lg.WithError(err).Warn("could not resolve bundle")
+				lookupSpan.End()
+				skipPod(ctx, lg, "bundle_unresolved", dryRun)
+				return &admv1.AdmissionResponse{
+					Allowed:  true,
+					Warnings: append(warnings, err.Error()),
+				}, nil
+			}
+			secretErr = bundles.check(pod.Namespace, bundle)
+		} else if issuer != "" {
+			_, _, secretErr = issuers.check(pod.Namespace, issuer)
+		} else if inline {
+			// Mounting a secret which may never exist helps nobody.
+			if inlineData, secretErr = inlineCA(cfg, secrets, pod); secretErr != nil {
+				lg.WithError(secretErr).Warn("could not get inline CA")
+				lookupSpan.End()
+				skipPod(ctx, lg, "inline_unusable", dryRun)
+				return &admv1.AdmissionResponse{
+					Allowed:  true,
+					Warnings: append(warnings, secretErr.Error()),
+				}, nil
+			}
+		} else {
+			if errs := validation.IsDNS1123Subdomain(srcName); len(errs) > 0 {
+				warnings = append(warnings, fmt.Sprintf("%q is not a valid secret name: %s", srcName, strings.Join(errs, "; ")))
+			}
+			key, _ := secretKey(cfg, pod)
+			secretErr = checkSecret(secrets, srcNs, srcName, key)
+		}
+		lookupSpan.End()
+		if err := secretErr; err != nil {
+			lg.WithError(err).Warn("referenced secret is not usable")
+			if !dryRun {
+				ctrSecretMissing.WithLabelValues(ar.Request.Namespace).Inc()
+			}
+			// Updates of a running pod are never rejected over its CA.
+			if cfg.GetString("secret.missing.policy") == "reject" && !optional(cfg, pod) && !update {
+				skipPod(ctx, lg, "secret_missing", dryRun)
+				return &admv1.AdmissionResponse{
+					Allowed: false,
+					Result: &metav1.Status{
+						Status:  metav1.StatusFailure,
+						Reason:  metav1.StatusReasonInvalid,
+						Code:    http.StatusUnprocessableEntity,
+						Message: fmt.Sprintf("ca-injector: %s", err),
+					},
+				}, nil
+			}
+			warnings = append(warnings, err.Error())
+		}
+
+		switch {
+		case dryRun || secret == "":
+		case auditMode(cfg):
+			if names := syncedSecrets(cfg, pod, secret); len(names) > 0 {
+				lg.WithField("secrets", names).Info("audit mode; would sync secrets")
+			}
+		default:
+			// Best effort, like the truststore below.
+			var err error
+			switch {
+			case issuer != "":
+				err = issuers.sync(ctx, cs, pod.Namespace, issuer)
+			case inline:
+				err = writeInline(ctx, cs, secrets, pod, inlineData)
+			case srcNs != pod.Namespace:
+				err = syncSecretCopy(ctx, cs, secrets, pod.Namespace, secret)
+			}
+			if err != nil {
+				lg.WithError(err).Error("could not sync secret copy")
+			}
+
+			local := localSecretName(pod.Namespace, secret)
+			if wantsKubeRoot(pod) {
+				if err := syncKubeRootBundle(ctx, cs, secrets, pod.Namespace, local); err != nil {
+					lg.WithError(err).Error("could not sync kube-root-ca.crt bundle secret")
+				}
+			} else if wantsDir(pod) {
+				if err := syncCertDir(ctx, cs, secrets, pod.Namespace, local); err != nil {
+					lg.WithError(err).Error("could not sync certificate directory secret")
+				}
+			} else if wantsJava(pod) {
+				// Best effort; the reconciler keeps retrying if this fails, and
+				// the kubelet will retry the mount until the secret exists.
+				if err := syncTruststore(ctx, cs, secrets, pod.Namespace, local); err != nil {
+					lg.WithError(err).Error("could not sync java truststore secret")
+				}
+			}
+		}
+
+		if len(imageRules) > 0 && lg.Logger.IsLevelEnabled(logrus.DebugLevel) {
+			for _, ctr := range mutate.Containers(pod) {
+				lg.WithFields(logrus.Fields{
+					"container": ctr.Name,
+					"image":     ctr.Image,
+					"rule":      ruleName(ctr),
+				}).Debug("effective image rule")
+			}
+		}
+
+		var (
+			patch []mutate.PatchOp
+			warns []string
+			bs    []byte
+		)
+		mcfg := mutateConfig(cfg, bundles, pod)
+		mcfg.EnvFrom = envFromSources(secrets, pod)
+		if update {
+			patch, warns, err = mutate.BuildUpdatePatch(oldPod, pod, mcfg)
+		} else {
+			mcfg.CAHash = injectionHash(cfg, secrets, pod)
+			key := patchKey(secrets, pod, mcfg)
+			if c := patches.get(key); c != nil {
+				patch, warns, bs = c.patch, c.warnings, c.bytes
+			} else if patch, warns, err = mutate.BuildPatch(pod, mcfg); err == nil {
+				if len(patch) > 0 {
+					bs = marshalPatch(ctx, patch)
+				}
+				patches.add(&cachedPatch{key: key, patch: patch, warnings: warns, bytes: bs})
+			}
+		}
+		if err != nil {
+			lg.WithError(err).Error("could not build patch")
+			return nil, err
+		}
+		warnings = append(warnings, warns...)
+
+		if !dryRun {
+			histPatchOps.Observe(float64(len(patch)))
+		}
+		trace.SpanFromContext(ctx).SetAttributes(attribute.Int("admission.patch.ops", len(patch)))
+
+		warnings = capWarnings(warnings)
+		if len(warnings) > 0 {
+			lg.WithField("warnings", warnings).Debug("returning warnings")
+		}
+
+		if len(patch) == 0 {
+			skipPod(ctx, lg, "already_injected", dryRun)
+			return &admv1.AdmissionResponse{
+				Allowed:  true,
+				Warnings: warnings,
+			}, nil
+		}
+
+		lg.WithField("patch", patch).Debug("patch")
+		lg = lg.WithFields(logrus.Fields{
+			"namespace": pod.Namespace,
+			"owner":     ownerName(pod),
+			"secret":    first(secret, bundle, cm),
+			"ops":       len(patch),
+		})
+
+		if auditMode(cfg) {
+			if !dryRun {
+				ctrWouldMutate.WithLabelValues(podMetricLabels(cfg, pod)...).Inc()
+			}
+			lg.WithField("patch", patch).Info("audit mode; would patch")
+			skipPod(ctx, lg, "audit", dryRun)
+			return &admv1.AdmissionResponse{
+				Allowed:  true,
+				Warnings: warnings,
+			}, nil
+		}
+
+		if !dryRun {
+			ctrPatches.WithLabelValues(podMetricLabels(cfg, pod)...).Inc()
+		}
+		lg.Info("patching")
+
+		if bs == nil {
+			bs = marshalPatch(ctx, patch)
+		}
+
+		pt := admv1.PatchTypeJSONPatch
+		return &admv1.AdmissionResponse{
+			Allowed:          true,
+			Patch:            bs,
+			PatchType:        &pt,
+			Warnings:         warnings,
+			AuditAnnotations: patchAuditAnnotations(ar.Request.UID, first(secret, bundle, cm), mutate.PatchedContainers(pod, patch)),
+			Result: &metav1.Status{
+				Message: "modified",
+			},
+		}, nil
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/spf13/viper"
+	admv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/microcumulus/ca-injector/mutate"
+)
+
+// newTestAdmitter returns the /pods handler for cfg, reading and writing the
+// objects of a fake clientset.
+func newTestAdmitter(t *testing.T, cfg *viper.Viper, objs ...runtime.Object) (admitHandler, *fake.Clientset) {
+	t.Helper()
+	cs := fake.NewSimpleClientset(objs...)
+	factory := informers.NewSharedInformerFactory(cs, time.Minute)
+	secrets := factory.Core().V1().Secrets().Lister()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	factory.Start(ctx.Done())
+	for typ, ok := range factory.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			t.Fatalf("could not sync %v", typ)
+		}
+	}
+	h := admitHandler{defaultTimeout: 10 * time.Second, margin: time.Second}
+	return h.with(admitPods(cfg, cs, secrets, nil, nil, "ca-injector")), cs
+}
+
+// podReview returns an admission.k8s.io/v1 review of the pod's creation, or
+// of its update from old.
+func podReview(t *testing.T, pod corev1.Pod, old *corev1.Pod) *admv1.AdmissionReview {
+	t.Helper()
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &admv1.AdmissionRequest{
+		UID:       types.UID("review-" + pod.Name),
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		Name:      pod.Name,
+		Namespace: pod.Namespace,
+		Operation: admv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+	if old != nil {
+		if req.OldObject.Raw, err = json.Marshal(old); err != nil {
+			t.Fatal(err)
+		}
+		req.Operation = admv1.Update
+	}
+	return &admv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: admv1.SchemeGroupVersion.String(), Kind: "AdmissionReview"},
+		Request:  req,
+	}
+}
+
+// post sends the body to the handler as JSON.
+func post(h http.Handler, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/pods", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// admit sends the review to the handler and returns its response, which must
+// be a 200.
+func admit(t *testing.T, h http.Handler, ar *admv1.AdmissionReview) *admv1.AdmissionResponse {
+	t.Helper()
+	body, err := json.Marshal(ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := post(h, body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var out admv1.AdmissionReview
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatalf("decoding response %s: %v", w.Body, err)
+	}
+	if out.Response == nil {
+		t.Fatalf("review has no response: %s", w.Body)
+	}
+	return out.Response
+}
+
+// secretWrites returns the verbs of the secrets created or updated through
+// the clientset.
+func secretWrites(cs *fake.Clientset) []string {
+	var verbs []string
+	for _, a := range cs.Actions() {
+		if a.GetResource().Resource == "secrets" && (a.GetVerb() == "create" || a.GetVerb() == "update") {
+			verbs = append(verbs, a.GetVerb())
+		}
+	}
+	return verbs
+}
+
+func TestAdmitDryRun(t *testing.T) {
+	cfg := newConfig()
+	cfg.Set("secret.source.namespaces", "pki")
+	pod := testPod("web", map[string]string{
+		"microcumul.us/injectssl":      "pki/corp-ca",
+		"microcumul.us/injectssl-java": "true",
+	})
+
+	for _, dryRun := range []bool{true, false} {
+		h, cs := newTestAdmitter(t, cfg, testSecret("pki", "corp-ca"))
+		patches := ctrPatches.WithLabelValues(podMetricLabels(cfg, pod)...)
+		missing := ctrSecretMissing.WithLabelValues(pod.Namespace)
+		beforePatches, beforeMissing := testutil.ToFloat64(patches), testutil.ToFloat64(missing)
+		beforeObserved := observations(t, histAdmission.WithLabelValues("patched"))
+
+		ar := podReview(t, pod, nil)
+		ar.Request.DryRun = &dryRun
+		res := admit(t, h, ar)
+
+		if !res.Allowed || res.PatchType == nil || *res.PatchType != admv1.PatchTypeJSONPatch {
+			t.Fatalf("dryRun %v: want an allowed JSON patch, got %+v", dryRun, res)
+		}
+		if got := applyPatch(t, pod, res.Patch); len(got.Spec.Volumes) == 0 {
+			t.Errorf("dryRun %v: patch adds no volume", dryRun)
+		}
+
+		want := 1.0
+		if dryRun {
+			want = 0
+		}
+		if d := testutil.ToFloat64(patches) - beforePatches; d != want {
+			t.Errorf("dryRun %v: ca_injector_pods_mutated moved by %v, want %v", dryRun, d, want)
+		}
+		if d := testutil.ToFloat64(missing) - beforeMissing; d != 0 {
+			t.Errorf("dryRun %v: ca_injector_secret_missing moved by %v", dryRun, d)
+		}
+		if d := observations(t, histAdmission.WithLabelValues("patched")) - beforeObserved; float64(d) != want {
+			t.Errorf("dryRun %v: ca_injector_admission_duration_seconds observed %d times, want %v", dryRun, d, want)
+		}
+		if writes := secretWrites(cs); dryRun && len(writes) > 0 {
+			t.Errorf("dry run wrote secrets: %v", writes)
+		} else if !dryRun && len(writes) == 0 {
+			t.Error("admission wrote no secrets")
+		}
+	}
+}
+
+func TestAdmitDryRunSkips(t *testing.T) {
+	cfg := newConfig()
+	cfg.Set("exclude.namespaces", "kube-system")
+	h, _ := newTestAdmitter(t, cfg)
+	excluded := testPod("excluded", map[string]string{label: "corp-ca"})
+	excluded.Namespace = "kube-system"
+
+	for _, tt := range []struct {
+		reason string
+		pod    corev1.Pod
+	}{
+		{reason: "no_annotation", pod: testPod("plain", nil)},
+		{reason: "optout", pod: testPod("optout", map[string]string{label: "false"})},
+		{reason: "excluded_namespace", pod: excluded},
+	} {
+		for _, dryRun := range []bool{true, false} {
+			skipped := ctrPodsSkipped.WithLabelValues(tt.reason)
+			before := testutil.ToFloat64(skipped)
+			beforeObserved := observations(t, histAdmission.WithLabelValues("allowed"))
+
+			ar := podReview(t, tt.pod, nil)
+			ar.Request.DryRun = &dryRun
+			admit(t, h, ar)
+
+			want := 1.0
+			if dryRun {
+				want = 0
+			}
+			if d := testutil.ToFloat64(skipped) - before; d != want {
+				t.Errorf("%s, dryRun %v: ca_injector_pods_skipped_total moved by %v, want %v", tt.reason, dryRun, d, want)
+			}
+			if d := observations(t, histAdmission.WithLabelValues("allowed")) - beforeObserved; float64(d) != want {
+				t.Errorf("%s, dryRun %v: ca_injector_admission_duration_seconds observed %d times, want %v", tt.reason, dryRun, d, want)
+			}
+		}
+	}
+}
+
+// observations returns how often the histogram was observed.
+func observations(t *testing.T, h prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := h.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestAdmitWarnings(t *testing.T) {
+	ann := func(kv ...string) map[string]string {
+		m := map[string]string{"microcumul.us/injectssl": "corp-ca"}
+		for i := 0; i < len(kv); i += 2 {
+			m[kv[i]] = kv[i+1]
+		}
+		return m
+	}
+	withEnv := testPod("env", ann())
+	withEnv.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "SSL_CERT_FILE", Value: "/etc/ssl/mine.pem"}}
+	withMount := testPod("mount", ann())
+	withMount.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "certs", MountPath: mutate.MountPath}}
+	windows := testPod("windows", ann())
+	windows.Spec.NodeSelector = map[string]string{osLabel: "windows"}
+	windowsMerge := testPod("windows-merge", ann(modeLabel, "merge"))
+	windowsMerge.Spec.NodeSelector = map[string]string{osLabel: "windows"}
+	many := testPod("many", ann())
+	for i := 0; i < 2*maxWarnings; i++ {
+		many.Annotations[fmt.Sprintf("microcumul.us/injectssl-typo-%02d", i)] = "true"
+	}
+
+	tests := []struct {
+		name string
+		cfg  map[string]string
+		pod  corev1.Pod
+		want string
+	}{
+		{name: "unknown annotation", pod: testPod("typo", ann("microcumul.us/injectssl-typo", "true")), want: `"microcumul.us/injectssl-typo" is not recognized`},
+		{name: "invalid mode bits", pod: testPod("bits", ann(modeBitsLabel, "999")), want: "is not an octal file mode"},
+		{name: "invalid secret key", pod: testPod("key", ann(keyLabel, "bad key")), want: "is not a valid secret key"},
+		{name: "invalid secret name", pod: testPod("name", ann(label, "Corp_CA")), want: `"Corp_CA" is not a valid secret name`},
+		{name: "missing secret", pod: testPod("missing", ann(label, "absent")), want: `secret "absent" not found in namespace "team"`},
+		{name: "env already set", pod: withEnv, want: `container "app" already sets SSL_CERT_FILE; leaving it alone`},
+		{name: "mount path taken", pod: withMount, want: `container "app" already mounts volume "certs" at ` + mutate.MountPath},
+		{name: "no default secret", pod: testPod("default", ann(label, "true")), want: "no default CA secret configured"},
+		{name: "secret not allowed", cfg: map[string]string{"secret.name.pattern": "^trusted-"}, pod: testPod("pattern", ann()), want: `may not inject secret "corp-ca"`},
+		{name: "source namespace not allowed", pod: testPod("source", ann(label, "pki/corp-ca")), want: `may not copy secret "pki/corp-ca"`},
+		{name: "windows", pod: windows, want: "does not inject the CA into Windows pods"},
+		{name: "merge on windows", cfg: map[string]string{"windows.policy": "inject"}, pod: windowsMerge, want: "merge mode needs a Linux init container"},
+		{name: "kube-root disabled", pod: testPod("kube-root", ann(kubeRootLabel, "true")), want: "needs KUBE_ROOT_BUNDLES=true"},
+		{name: "capped", pod: many, want: fmt.Sprintf("and %d more warnings", maxWarnings+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newConfig()
+			for k, v := range tt.cfg {
+				cfg.Set(k, v)
+			}
+			h, _ := newTestAdmitter(t, cfg, testSecret("team", "corp-ca"))
+			res := admit(t, h, podReview(t, tt.pod, nil))
+			if !res.Allowed {
+				t.Fatalf("denied: %+v", res.Result)
+			}
+			if len(res.Warnings) > maxWarnings {
+				t.Errorf("%d warnings, want at most %d", len(res.Warnings), maxWarnings)
+			}
+			for _, w := range res.Warnings {
+				if strings.Contains(w, tt.want) {
+					return
+				}
+			}
+			t.Errorf("no warning containing %q in %q", tt.want, res.Warnings)
+		})
+	}
+}
+
+func TestAdmitOtherKinds(t *testing.T) {
+	h, _ := newTestAdmitter(t, newConfig())
+	raw, err := json.Marshal(corev1.ConfigMap{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{Name: "settings", Namespace: "team", Annotations: map[string]string{label: "corp-ca"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar := podReview(t, testPod("unused", nil), nil)
+	ar.Request.Kind = metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	ar.Request.Resource = metav1.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	ar.Request.Name = "settings"
+	ar.Request.Object = runtime.RawExtension{Raw: raw}
+
+	res := admit(t, h, ar)
+	if !res.Allowed || res.Patch != nil || res.PatchType != nil {
+		t.Errorf("want the config map allowed unchanged, got %+v", res)
+	}
+	if len(res.Warnings) != 1 || !strings.Contains(res.Warnings[0], "only handles pods") {
+		t.Errorf("warnings = %q", res.Warnings)
+	}
+
+	pod := testPod("web", map[string]string{label: "corp-ca"})
+	ar = podReview(t, pod, nil)
+	ar.Request.Operation = admv1.Delete
+	if res := admit(t, h, ar); !res.Allowed || res.Patch != nil || len(res.Warnings) > 0 {
+		t.Errorf("want the delete allowed untouched, got %+v", res)
+	}
+}
+
+func TestAdmitUpdate(t *testing.T) {
+	ann := map[string]string{label: "corp-ca"}
+	injected := injectedPod(t, testPod("web", ann), "corp-ca")
+	debug := corev1.EphemeralContainer{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debug", Image: "busybox"}}
+
+	relabeled := *injected.DeepCopy()
+	relabeled.Labels = map[string]string{"tier": "web"}
+	debugged := *injected.DeepCopy()
+	debugged.Spec.EphemeralContainers = []corev1.EphemeralContainer{debug}
+	plain := testPod("plain", ann)
+	plainDebugged := *plain.DeepCopy()
+	plainDebugged.Spec.EphemeralContainers = []corev1.EphemeralContainer{debug}
+
+	tests := []struct {
+		name     string
+		old, pod corev1.Pod
+		mounted  bool
+	}{
+		{name: "injected pod relabeled", old: injected, pod: relabeled},
+		{name: "injected pod debugged", old: injected, pod: debugged, mounted: true},
+		{name: "uninjected pod debugged", old: plain, pod: plainDebugged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, cs := newTestAdmitter(t, newConfig(), testSecret("team", "corp-ca"))
+			res := admit(t, h, podReview(t, tt.pod, &tt.old))
+			if !res.Allowed || len(res.Warnings) > 0 {
+				t.Fatalf("want allowed without warnings, got %+v", res)
+			}
+			if writes := secretWrites(cs); len(writes) > 0 {
+				t.Errorf("update wrote secrets: %v", writes)
+			}
+			if !tt.mounted {
+				if res.Patch != nil || res.PatchType != nil {
+					t.Errorf("want no patch, got %s", res.Patch)
+				}
+				return
+			}
+			got := applyPatch(t, tt.pod, res.Patch)
+			if vms := got.Spec.EphemeralContainers[0].VolumeMounts; len(vms) != 1 || vms[0].MountPath != mutate.MountPath {
+				t.Errorf("debug container mounts %+v", vms)
+			}
+			if len(got.Spec.Volumes) != len(tt.pod.Spec.Volumes) {
+				t.Errorf("update changed the volumes: %+v", got.Spec.Volumes)
+			}
+		})
+	}
+}
+
+func TestAdmitNoPatch(t *testing.T) {
+	ann := map[string]string{label: "corp-ca"}
+	tests := []struct {
+		name string
+		cfg  map[string]string
+		pod  corev1.Pod
+	}{
+		{name: "not annotated", pod: testPod("plain", nil)},
+		{name: "empty annotation", pod: testPod("empty", map[string]string{label: ""})},
+		{name: "opted out", pod: testPod("optout", map[string]string{label: "false"})},
+		{name: "excluded namespace", cfg: map[string]string{"exclude.namespaces": "te*"}, pod: testPod("excluded", ann)},
+		{name: "already injected", pod: injectedPod(t, testPod("injected", ann), "corp-ca")},
+		{name: "audit mode", cfg: map[string]string{"mode": "audit"}, pod: testPod("audited", ann)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newConfig()
+			for k, v := range tt.cfg {
+				cfg.Set(k, v)
+			}
+			h, _ := newTestAdmitter(t, cfg, testSecret("team", "corp-ca"))
+			res := admit(t, h, podReview(t, tt.pod, nil))
+			if !res.Allowed {
+				t.Fatalf("denied: %+v", res.Result)
+			}
+			if res.Patch != nil || res.PatchType != nil {
+				t.Errorf("want no patch and no patch type, got %q of type %v", res.Patch, res.PatchType)
+			}
+		})
+	}
+}
+
+func TestAdmitWritesSecretsOnlyWhenEnforcing(t *testing.T) {
+	for _, mode := range []string{"enforce", "audit"} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := newConfig()
+			cfg.Set("secret.source.namespaces", "pki")
+			cfg.Set("mode", mode)
+			h, cs := newTestAdmitter(t, cfg, testSecret("pki", "corp-ca"))
+			pod := testPod("java", map[string]string{
+				"microcumul.us/injectssl":      "pki/corp-ca",
+				"microcumul.us/injectssl-java": "true",
+			})
+
+			admit(t, h, podReview(t, pod, nil))
+			if written := secretWrites(cs); (len(written) > 0) != (mode == "enforce") {
+				t.Errorf("secrets written: %v", written)
+			}
+		})
+	}
+}
+
+func TestAdmitWarnsOfLegacyPrefix(t *testing.T) {
+	cfg := newConfig()
+	cfg.Set("annotation.prefix", "example.com")
+	cfg.Set("legacy.annotation.prefix", true)
+	if err := setAnnotationPrefix(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := setAnnotationPrefix(newConfig()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	h, _ := newTestAdmitter(t, cfg, testSecret("team", "corp-ca"))
+	res := admit(t, h, podReview(t, testPod("web", map[string]string{"microcumul.us/injectssl": "corp-ca"}), nil))
+	if res.Patch == nil {
+		t.Error("the legacy annotation was not honored")
+	}
+	want := `"microcumul.us/injectssl" is deprecated; use "example.com/injectssl"`
+	if len(res.Warnings) != 1 || res.Warnings[0] != want {
+		t.Errorf("warnings %q, want %q", res.Warnings, want)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+
+	admv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// maxAuditValueLen keeps audit annotations short; audit logs keep every one
+// on every event.
+const maxAuditValueLen = 256
+
+// patchAuditAnnotations are recorded in the API server's audit log for pods
+// the webhook patches, so injections can be proven from the audit log alone.
+// The API server prefixes each key with the webhook's name, e.g.
+// ca-injector.microcumul.us/secret, so the keys carry no prefix of their own.
+// The UID is the admission's, which the injector's log lines carry too.
+func patchAuditAnnotations(uid types.UID, secret string, containers []string) map[string]string {
+	return map[string]string{
+		"secret":     auditValue(secret),
+		"containers": auditValue(strings.Join(containers, ",")),
+		"version":    auditValue(version),
+		"uid":        string(uid),
+	}
+}
+
+// auditSkipped records why a review was not patched, for handlers with
+// auditSkips set, unless the handler recorded annotations itself.
+func (h admitHandler) auditSkipped(res *admv1.AdmissionResponse, reason string) {
+	if !h.auditSkips || res.Patch != nil || len(res.AuditAnnotations) > 0 || reason == "" {
+		return
+	}
+	res.AuditAnnotations = map[string]string{"skipped": reason}
+}
+
+func auditValue(s string) string {
+	if len(s) > maxAuditValueLen {
+		return s[:maxAuditValueLen-3] + "..."
+	}
+	return s
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestAuditAnnotations(t *testing.T) {
+	ann := map[string]string{label: "corp-ca"}
+	patched := map[string]string{"secret": "corp-ca", "containers": "app", "version": version, "uid": "review-web"}
+	tests := []struct {
+		name       string
+		pod        string
+		ann        map[string]string
+		dryRun     bool
+		auditSkips bool
+		want       map[string]string
+	}{
+		{name: "patched", pod: "web", ann: ann, want: patched},
+		{name: "dry run", pod: "web", ann: ann, dryRun: true, want: patched},
+		{name: "skipped", pod: "plain", auditSkips: true, want: map[string]string{"skipped": "no_annotation"}},
+		{name: "skipped without auditSkips", pod: "plain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestAdmitter(t, newConfig(), testSecret("team", "corp-ca"))
+			h.auditSkips = tt.auditSkips
+			ar := podReview(t, testPod(tt.pod, tt.ann), nil)
+			ar.Request.DryRun = &tt.dryRun
+
+			res := admit(t, h, ar)
+			if !reflect.DeepEqual(res.AuditAnnotations, tt.want) {
+				t.Errorf("audit annotations %v, want %v", res.AuditAnnotations, tt.want)
+			}
+			for k := range res.AuditAnnotations {
+				// The API server prefixes the keys with the webhook's name.
+				if errs := validation.IsQualifiedName("ca-injector.microcumul.us/" + k); len(errs) > 0 {
+					t.Errorf("key %q: %v", k, errs)
+				}
+			}
+		})
+	}
+}
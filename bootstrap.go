@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	bootstrapCAValidity      = 10 * 365 * 24 * time.Hour
+	bootstrapServingValidity = 365 * 24 * time.Hour
+	// bootstrapRenewBefore is how long before expiry the serving cert is
+	// replaced.
+	bootstrapRenewBefore = 30 * 24 * time.Hour
+)
+
+// bootstrapper provisions a self-signed serving certificate when none is
+// mounted, keeps it in a secret so all replicas and restarts share it, and
+// points the MutatingWebhookConfiguration at its CA.
+type bootstrapper struct {
+	cs    kubernetes.Interface
+	certs *certReloader
+
+	namespace string
+	secret    string
+	service   string
+	webhook   string
+
+	mu sync.Mutex
+	ca []byte
+}
+
+func newBootstrapper(cs kubernetes.Interface, certs *certReloader, cfg *viper.Viper) *bootstrapper {
+	return &bootstrapper{
+		cs:        cs,
+		certs:     certs,
+		namespace: podNamespace(cfg),
+		secret:    cfg.GetString("bootstrap.secret"),
+		service:   cfg.GetString("service.name"),
+		webhook:   cfg.GetString("webhook.name"),
+	}
+}
+
+// run renews the certificate shortly before it expires until ctx is
+// cancelled.
+func (b *bootstrapper) run(ctx context.Context) {
+	for {
+		wait := time.Until(b.certs.notAfter().Add(-bootstrapRenewBefore))
+		if wait < time.Minute {
+			wait = time.Minute
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if err := b.ensure(ctx); err != nil {
+			lg.WithError(err).Error("could not renew bootstrapped serving certificate")
+		}
+	}
+}
+
+// ensure loads the keypair from the secret, generating or renewing it as
+// needed, and makes sure the webhook trusts its CA.
+func (b *bootstrapper) ensure(ctx context.Context) error {
+	secrets := b.cs.CoreV1().Secrets(b.namespace)
+	cur, err := secrets.Get(ctx, b.secret, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error getting secret %s/%s: %w", b.namespace, b.secret, err)
+	}
+	exists := err == nil
+
+	var caCrt, caKey, crt, key []byte
+	if exists {
+		caCrt, caKey = cur.Data["ca.crt"], cur.Data["ca.key"]
+		crt, key = cur.Data[corev1.TLSCertKey], cur.Data[corev1.TLSPrivateKeyKey]
+	}
+
+	if !b.valid(crt, caCrt) {
+		lg.WithField("secret", b.namespace+"/"+b.secret).Info("generating serving certificate")
+		ca, signer, err := parseCA(caCrt, caKey)
+		if err != nil || time.Until(ca.NotAfter) < bootstrapServingValidity {
+			caCrt, caKey, err = generateCA(b.service)
+			if err != nil {
+				return err
+			}
+			if ca, signer, err = parseCA(caCrt, caKey); err != nil {
+				return err
+			}
+		}
+		crt, key, err = generateServing(ca, signer, b.dnsNames())
+		if err != nil {
+			return err
+		}
+
+		data := map[string][]byte{
+			"ca.crt":                caCrt,
+			"ca.key":                caKey,
+			corev1.TLSCertKey:       crt,
+			corev1.TLSPrivateKeyKey: key,
+		}
+		if exists {
+			cur = cur.DeepCopy()
+			cur.Data = data
+			_, err = secrets.Update(ctx, cur, metav1.UpdateOptions{})
+		} else {
+			_, err = secrets.Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      b.secret,
+					Namespace: b.namespace,
+					Labels: map[string]string{
+						"app.kubernetes.io/managed-by": "ca-injector",
+					},
+				},
+				Type: corev1.SecretTypeTLS,
+				Data: data,
+			}, metav1.CreateOptions{})
+		}
+		if apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) {
+			// Another replica got there first; use its certificate.
+			return b.ensure(ctx)
+		}
+		if err != nil {
+			return fmt.Errorf("error storing serving certificate in %s/%s: %w", b.namespace, b.secret, err)
+		}
+	}
+
+	if err := b.certs.set(crt, key); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.ca = caCrt
+	b.mu.Unlock()
+	if err := b.patchWebhook(ctx, caCrt); err != nil {
+		return err
+	}
+	return b.patchValidatingWebhook(ctx, caCrt)
+}
+
+// caBundle returns the CA of the current serving certificate.
+func (b *bootstrapper) caBundle() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ca
+}
+
+// valid reports whether the serving cert is signed by the CA, covers the
+// service and is not due for renewal.
+func (b *bootstrapper) valid(crt, caCrt []byte) bool {
+	cert, err := parseCert(crt)
+	if err != nil {
+		return false
+	}
+	ca, err := parseCert(caCrt)
+	if err != nil {
+		return false
+	}
+	if time.Until(cert.NotAfter) < bootstrapRenewBefore || cert.CheckSignatureFrom(ca) != nil {
+		return false
+	}
+	for _, name := range b.dnsNames() {
+		if cert.VerifyHostname(name) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bootstrapper) dnsNames() []string {
+	return []string{
+		b.service,
+		b.service + "." + b.namespace,
+		b.service + "." + b.namespace + ".svc",
+		b.service + "." + b.namespace + ".svc.cluster.local",
+	}
+}
+
+// patchWebhook sets the caBundle of every webhook in the configuration.
+func (b *bootstrapper) patchWebhook(ctx context.Context, caCrt []byte) error {
+	mwcs := b.cs.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	mwc, err := mwcs.Get(ctx, b.webhook, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		lg.WithField("webhook", b.webhook).Warn("mutating webhook configuration not found; not setting its caBundle")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error getting mutating webhook configuration %s: %w", b.webhook, err)
+	}
+
+	changed := false
+	mwc = mwc.DeepCopy()
+	for i := range mwc.Webhooks {
+		if !bytes.Equal(mwc.Webhooks[i].ClientConfig.CABundle, caCrt) {
+			mwc.Webhooks[i].ClientConfig.CABundle = caCrt
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if _, err := mwcs.Update(ctx, mwc, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("error updating caBundle of %s: %w", b.webhook, err)
+	}
+	lg.WithField("webhook", b.webhook).Info("updated webhook caBundle")
+	return nil
+}
+
+// patchValidatingWebhook sets the caBundle of the validating configuration
+// of the same name, if there is one.
+func (b *bootstrapper) patchValidatingWebhook(ctx context.Context, caCrt []byte) error {
+	vwcs := b.cs.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+	vwc, err := vwcs.Get(ctx, b.webhook, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error getting validating webhook configuration %s: %w", b.webhook, err)
+	}
+
+	changed := false
+	vwc = vwc.DeepCopy()
+	for i := range vwc.Webhooks {
+		if !bytes.Equal(vwc.Webhooks[i].ClientConfig.CABundle, caCrt) {
+			vwc.Webhooks[i].ClientConfig.CABundle = caCrt
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if _, err := vwcs.Update(ctx, vwc, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("error updating caBundle of validating webhook %s: %w", b.webhook, err)
+	}
+	lg.WithField("webhook", b.webhook).Info("updated validating webhook caBundle")
+	return nil
+}
+
+func generateCA(name string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error generating CA key: %w", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial(),
+		Subject:               pkix.Name{CommonName: name + "-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(bootstrapCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating CA certificate: %w", err)
+	}
+	return encodeKeypair(der, key)
+}
+
+func generateServing(ca *x509.Certificate, signer *ecdsa.PrivateKey, dnsNames []string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error generating serving key: %w", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial(),
+		Subject:      pkix.Name{CommonName: dnsNames[len(dnsNames)-2]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(bootstrapServingValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, signer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating serving certificate: %w", err)
+	}
+	return encodeKeypair(der, key)
+}
+
+func encodeKeypair(der []byte, key *ecdsa.PrivateKey) ([]byte, []byte, error) {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error encoding key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+func parseCA(crt, key []byte) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	cert, err := parseCert(crt)
+	if err != nil {
+		return nil, nil, err
+	}
+	blk, _ := pem.Decode(key)
+	if blk == nil {
+		return nil, nil, fmt.Errorf("no CA key found")
+	}
+	signer, err := x509.ParseECPrivateKey(blk.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing CA key: %w", err)
+	}
+	return cert, signer, nil
+}
+
+func parseCert(crt []byte) (*x509.Certificate, error) {
+	blk, _ := pem.Decode(crt)
+	if blk == nil {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	return x509.ParseCertificate(blk.Bytes)
+}
+
+func serial() *big.Int {
+	n, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return n
+}
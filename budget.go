@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// deleteBudget limits how many pods the reconciler deletes per cycle, how
+// closely deletes follow one another, and caps deletes to one per owner per
+// cycle so a whole workload is never taken out at once.
+type deleteBudget struct {
+	mu      sync.Mutex
+	start   time.Time
+	deletes int
+	owners  map[types.UID]bool
+	last    time.Time
+}
+
+// take reserves a delete for a pod with the given controller UID (empty for
+// bare pods). When the delete may not proceed yet it returns false along with
+// how long to wait before trying again, and whether the wait is because the
+// cycle's budget is used up rather than just the spacing between deletes.
+func (b *deleteBudget) take(now time.Time, owner types.UID, cycle time.Duration, max int, spacing time.Duration) (ok bool, wait time.Duration, deferred bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.owners == nil || now.Sub(b.start) >= cycle {
+		b.start = now
+		b.deletes = 0
+		b.owners = map[types.UID]bool{}
+	}
+
+	if b.deletes >= max || (owner != "" && b.owners[owner]) {
+		return false, b.start.Add(cycle).Sub(now), true
+	}
+	if since := now.Sub(b.last); since < spacing {
+		return false, spacing - since, false
+	}
+
+	b.deletes++
+	if owner != "" {
+		b.owners[owner] = true
+	}
+	b.last = now
+	return true, 0, false
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var bundleLabel = "microcumul.us/injectssl-bundle"
+
+var bundleGVR = schema.GroupVersionResource{Group: "trust.cert-manager.io", Version: "v1alpha1", Resource: "bundles"}
+
+// bundleResolver finds where trust-manager writes a Bundle in each namespace.
+type bundleResolver struct {
+	factory    dynamicinformer.DynamicSharedInformerFactory
+	bundles    cache.GenericLister
+	configMaps corelisters.ConfigMapLister
+	secrets    corelisters.SecretLister
+}
+
+// newBundleResolver registers informers for Bundles with a new factory and for
+// config maps with the given one; both must be started afterwards.
+func newBundleResolver(dyn dynamic.Interface, factory informers.SharedInformerFactory) *bundleResolver {
+	f := dynamicinformer.NewDynamicSharedInformerFactory(dyn, 10*time.Minute)
+	return &bundleResolver{
+		factory:    f,
+		bundles:    f.ForResource(bundleGVR).Lister(),
+		configMaps: factory.Core().V1().ConfigMaps().Lister(),
+		secrets:    factory.Core().V1().Secrets().Lister(),
+	}
+}
+
+// bundleFor returns the Bundle the pod asks for, if Bundle support is enabled
+// and the pod does not ask for a secret or issuer.
+func bundleFor(cfg *viper.Viper, pod corev1.Pod) string {
+	if !cfg.GetBool("trust.manager.bundles") || secretName(cfg, pod) != "" || optedOut(pod) {
+		return ""
+	}
+	return annotation(pod.Annotations, bundleLabel)
+}
+
+// bundleTarget is where trust-manager writes a Bundle: an object of the
+// Bundle's name in every namespace, holding the bundle under key.
+type bundleTarget struct {
+	configMap bool
+	key       string
+}
+
+// target reads the Bundle's spec.target.
+func (br *bundleResolver) target(name string) (bundleTarget, error) {
+	obj, err := br.bundles.Get(name)
+	if err != nil {
+		return bundleTarget{}, fmt.Errorf("error getting bundle %q: %w", name, err)
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return bundleTarget{}, fmt.Errorf("unexpected type %T for bundle %q", obj, name)
+	}
+	if key, ok, _ := unstructured.NestedString(u.Object, "spec", "target", "configMap", "key"); ok && key != "" {
+		return bundleTarget{configMap: true, key: key}, nil
+	}
+	if key, ok, _ := unstructured.NestedString(u.Object, "spec", "target", "secret", "key"); ok && key != "" {
+		return bundleTarget{key: key}, nil
+	}
+	return bundleTarget{}, fmt.Errorf("bundle %q has no config map or secret target", name)
+}
+
+// check verifies the Bundle's target has been written to the namespace.
+func (br *bundleResolver) check(namespace, name string) error {
+	t, err := br.target(name)
+	if err != nil {
+		return err
+	}
+
+	var present bool
+	if t.configMap {
+		cm, err := br.configMaps.ConfigMaps(namespace).Get(name)
+		if err != nil {
+			return fmt.Errorf("config map %q of bundle %q is not in namespace %q yet: %w", name, name, namespace, err)
+		}
+		_, present = cm.Data[t.key]
+	} else {
+		s, err := br.secrets.Secrets(namespace).Get(name)
+		if err != nil {
+			return fmt.Errorf("secret %q of bundle %q is not in namespace %q yet: %w", name, name, namespace, err)
+		}
+		_, present = s.Data[t.key]
+	}
+	if !present {
+		return fmt.Errorf("target of bundle %q in namespace %q has no %q key yet", name, namespace, t.key)
+	}
+	return nil
+}
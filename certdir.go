@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+
+	"github.com/microcumulus/ca-injector/mutate"
+)
+
+var dirLabel = "microcumul.us/injectssl-dir"
+
+const (
+	// certDirAnnotation marks secret copies holding a certificate directory.
+	certDirAnnotation = "microcumul.us/cert-dir"
+	// certDirBundleKey holds all certificates of a directory concatenated,
+	// for NODE_EXTRA_CA_CERTS which only takes a file.
+	certDirBundleKey = mutate.DirBundleFile
+)
+
+// wantsDir reports whether the pod opted in to having the whole secret mounted
+// as SSL_CERT_DIR.
+func wantsDir(pod corev1.Pod) bool {
+	return annotation(pod.Annotations, dirLabel) == "true"
+}
+
+// certDirSecretName is the name of the secret derived from a CA secret with
+// several certificates which additionally holds them concatenated.
+func certDirSecretName(secret string) string {
+	return secret + "-certdir"
+}
+
+// syncCertDir makes sure the derived certificate directory secret for the
+// given secret exists in the namespace, holding every key of the source with
+// PEM certificates and their concatenation under bundle.pem. Reads are served
+// from the informer cache.
+func syncCertDir(ctx context.Context, cs kubernetes.Interface, sl corelisters.SecretLister, namespace, secret string) error {
+	src, err := sl.Secrets(namespace).Get(secret)
+	if err != nil {
+		return fmt.Errorf("error getting source secret %s/%s: %w", namespace, secret, err)
+	}
+
+	keys := make([]string, 0, len(src.Data))
+	for k := range src.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	data := map[string][]byte{}
+	var bundle bytes.Buffer
+	for _, k := range keys {
+		if k == certDirBundleKey || !hasCertificate(src.Data[k]) {
+			continue
+		}
+		data[k] = src.Data[k]
+		bundle.Write(bytes.TrimSpace(src.Data[k]))
+		bundle.WriteByte('\n')
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("source secret %s/%s holds no PEM certificates", namespace, secret)
+	}
+	data[certDirBundleKey] = bundle.Bytes()
+
+	return writeCopy(ctx, cs, sl, namespace, certDirSecretName(secret), namespace+"/"+secret, nil, map[string]string{
+		certDirAnnotation: "true",
+	}, data)
+}
+
+func hasCertificate(bs []byte) bool {
+	for {
+		var blk *pem.Block
+		blk, bs = pem.Decode(bs)
+		if blk == nil {
+			return false
+		}
+		if blk.Type == "CERTIFICATE" {
+			return true
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// certReloader serves the webhook keypair from disk, picking up rotated
+// material (e.g. from cert-manager) without a restart. A bootstrapped keypair
+// is set directly instead, leaving the files empty.
+type certReloader struct {
+	crtFile, keyFile string
+
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	until time.Time
+}
+
+func newCertReloader(crtFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{
+		crtFile: crtFile,
+		keyFile: keyFile,
+	}
+	return c, c.load()
+}
+
+// load reads the keypair from disk, replacing the current one only if it is
+// valid.
+func (c *certReloader) load() error {
+	crt, err := ioutil.ReadFile(c.crtFile)
+	if err != nil {
+		return fmt.Errorf("error reading cert: %w", err)
+	}
+	key, err := ioutil.ReadFile(c.keyFile)
+	if err != nil {
+		return fmt.Errorf("error reading key: %w", err)
+	}
+	return c.set(crt, key)
+}
+
+// set replaces the current keypair with the PEM encoded one, if it is valid.
+func (c *certReloader) set(crt, key []byte) error {
+	cert, err := tls.X509KeyPair(crt, key)
+	if err != nil {
+		return fmt.Errorf("error loading keypair: %w", err)
+	}
+
+	first, err := getFirstExpiringCert(bytes.NewReader(crt))
+	if err != nil {
+		return fmt.Errorf("could not read cert end date for certificate: %w", err)
+	}
+	if first == nil {
+		return fmt.Errorf("no certificates found in serving certificate")
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.until = first.NotAfter
+	c.mu.Unlock()
+
+	gaugeCertExpiry.Set(float64(first.NotAfter.Unix()))
+	lg.WithField("notAfter", first.NotAfter).Info("loaded serving certificate")
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// notAfter returns the expiry of the first expiring cert in the current chain.
+func (c *certReloader) notAfter() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.until
+}
+
+// watch reloads the keypair whenever the directories holding it change, until
+// ctx is cancelled. Directories are watched rather than the files because
+// secret volumes are updated by swapping a symlink.
+func (c *certReloader) watch(ctx context.Context) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		lg.WithError(err).Error("could not watch serving certificate; it will not be reloaded")
+		return
+	}
+	defer w.Close()
+
+	for _, dir := range []string{filepath.Dir(c.crtFile), filepath.Dir(c.keyFile)} {
+		if err := w.Add(dir); err != nil {
+			lg.WithError(err).WithField("dir", dir).Error("could not watch serving certificate; it will not be reloaded")
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-w.Errors:
+			lg.WithError(err).Error("error watching serving certificate")
+		case <-w.Events:
+			if err := c.load(); err != nil {
+				lg.WithError(err).Error("could not reload serving certificate; continuing with the previous one")
+			}
+		}
+	}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// serverTLSConfig returns the webhook listener's TLS settings: TLS_MIN_VERSION,
+// TLS_CIPHER_SUITES if set, and client certificates verified against
+// TLS_CLIENT_CA_FILE if set. It also returns a summary for the log.
+func serverTLSConfig(cfg *viper.Viper, certs *certReloader) (*tls.Config, string, error) {
+	min, ok := tlsVersions[cfg.GetString("tls.min.version")]
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported TLS_MIN_VERSION %q; use 1.2 or 1.3", cfg.GetString("tls.min.version"))
+	}
+	tc := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     min,
+	}
+	policy := "min TLS " + cfg.GetString("tls.min.version")
+
+	if names := splitList(cfg.GetString("tls.cipher.suites")); len(names) > 0 {
+		ids := map[string]uint16{}
+		for _, cs := range tls.CipherSuites() {
+			ids[cs.Name] = cs.ID
+		}
+		for _, name := range names {
+			id, ok := ids[name]
+			if !ok {
+				return nil, "", fmt.Errorf("unknown or insecure cipher suite %q in TLS_CIPHER_SUITES", name)
+			}
+			tc.CipherSuites = append(tc.CipherSuites, id)
+		}
+		// TLS 1.3 suites are not configurable.
+		policy += ", TLS 1.2 cipher suites " + strings.Join(names, ",")
+	}
+
+	if f := cfg.GetString("tls.client.ca.file"); f != "" {
+		bs, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, "", fmt.Errorf("error reading TLS_CLIENT_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bs) {
+			return nil, "", fmt.Errorf("no certificates found in TLS_CLIENT_CA_FILE %s", f)
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+		policy += ", client certificates verified against " + f
+	} else {
+		policy += ", client certificates not verified"
+	}
+	return tc, policy, nil
+}
@@ -1,46 +1,337 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
 	"strings"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
 var (
 	lg = logrus.New()
+
+	components = pflag.String("components", "all", "what to run: the webhook, the reconciler or all")
+	configFile = pflag.String("config", "", "YAML file holding the settings, reloaded when it changes")
 )
 
+// runsWebhook and runsReconciler report which parts --components selects.
+func runsWebhook() bool    { return *components != "reconciler" }
+func runsReconciler() bool { return *components != "webhook" }
+
+// setupConfig reads the settings from the environment and the config file:
+// --config, or else the first ca-injector.yaml (or any other format viper
+// reads) in the working directory, $HOME/ca-injector and /etc/ca-injector.
+// Environment variables take precedence over the file.
 func setupConfig() *viper.Viper {
-	cfg := viper.New()
-	cfg.AddConfigPath(".")
-	cfg.AddConfigPath("$HOME/ca-injector")
-	cfg.AddConfigPath("/etc/ca-injector")
+	cfg := newConfig()
+	if *configFile != "" {
+		cfg.SetConfigFile(*configFile)
+	} else {
+		cfg.AddConfigPath(".")
+		cfg.AddConfigPath("$HOME/ca-injector")
+		cfg.AddConfigPath("/etc/ca-injector")
+		cfg.SetConfigName("ca-injector")
+	}
 
-	cfg.SetConfigName("ca-injector")
+	err := cfg.ReadInConfig()
+	switch {
+	case err == nil:
+		if err := validateConfig(cfg); err != nil {
+			lg.WithError(err).WithField("file", cfg.ConfigFileUsed()).Fatal("invalid config file")
+		}
+		if bs, err := ioutil.ReadFile(cfg.ConfigFileUsed()); err == nil {
+			setConfigHash(bs)
+		}
+	case *configFile != "":
+		lg.WithError(err).WithField("file", *configFile).Fatal("could not read config file")
+	default:
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			lg.WithError(err).Error("could not read initial config")
+		}
+		setConfigHash(nil)
+	}
+	setupLogging(cfg)
+
+	return cfg
+}
 
+// newConfig returns settings with every default and the environment, but no
+// config file.
+func newConfig() *viper.Viper {
+	cfg := viper.New()
 	cfg.AutomaticEnv()
 	cfg.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 
-	cfg.SetDefault("tls.key", "/cert/tls.key")
-	cfg.SetDefault("tls.crt", "/cert/tls.crt")
+	// debug, info, warn or error
+	cfg.SetDefault("log.level", "info")
+	// json or text; defaults to json when running in a cluster
+	cfg.SetDefault("log.format", "")
+
+	// enforce, or audit to only log and count what would be patched or
+	// deleted
+	cfg.SetDefault("mode", "enforce")
+
+	// domain of the annotations and labels read from workloads and of the
+	// markers written to them; with legacy.annotation.prefix, the default
+	// domain is honored too while workloads migrate
+	cfg.SetDefault("annotation.prefix", "microcumul.us")
+	cfg.SetDefault("legacy.annotation.prefix", false)
+
+	cfg.SetDefault("listen.addr", ":8443")
+	cfg.SetDefault("metrics.addr", ":9090")
+	// serve /debug/pprof/ on the metrics listener
+	cfg.SetDefault("enable.pprof", false)
+	cfg.SetDefault("tls.key.file", "/cert/tls.key")
+	cfg.SetDefault("tls.cert.file", "/cert/tls.crt")
+	cfg.SetDefault("tls.min.version", "1.2")
+	// comma-separated Go names of TLS 1.2 cipher suites; empty for Go's
+	// defaults
+	cfg.SetDefault("tls.cipher.suites", "")
+	// CA bundle to require and verify client certificates against
+	cfg.SetDefault("tls.client.ca.file", "")
+	// older config files used these keys
+	cfg.RegisterAlias("tls.key", "tls.key.file")
+	cfg.RegisterAlias("tls.crt", "tls.cert.file")
+	// on SIGTERM, how long to keep serving after failing /readyz, and how long
+	// to then wait for in-flight requests
+	cfg.SetDefault("shutdown.delay", "5s")
+	cfg.SetDefault("shutdown.timeout", "30s")
+	// serve plain HTTP, e.g. behind a mesh sidecar terminating TLS
+	cfg.SetDefault("insecure.http", false)
+	// how often the webhook calls itself to check its certificate and
+	// responses; 0 disables the check
+	cfg.SetDefault("selfcheck.interval", "1m")
+	// without a mounted cert, generate one, keep it in bootstrap.secret and
+	// set the caBundle of webhook.name
+	cfg.SetDefault("bootstrap.cert", true)
+	cfg.SetDefault("bootstrap.secret", "ca-injector-tls")
+	cfg.SetDefault("service.name", "ca-injector")
+	cfg.SetDefault("webhook.name", "ca-injector.microcumul.us")
+
+	// deny, or warn about, pods whose CA cannot be injected on /validate
+	cfg.SetDefault("validate.policy", "deny")
+
+	// answer admissions this long before the API server's timeout, allowing
+	// them (allow) or denying them (deny)
+	cfg.SetDefault("admission.timeout.margin", "1s")
+	cfg.SetDefault("admission.timeout.policy", "allow")
+	// largest admission review read, in bytes; reviews of pod updates carry
+	// the pod twice
+	cfg.SetDefault("admission.max.body.bytes", 8<<20)
+	// how many admissions are handled at once, 0 for no limit; how long a
+	// review waits for its turn; and whether those that waited too long are
+	// allowed unpatched (allow) or answered with an error (error), leaving
+	// them to the webhook's failurePolicy
+	cfg.SetDefault("admission.max.concurrent", 64)
+	cfg.SetDefault("admission.queue.timeout", "2s")
+	cfg.SetDefault("admission.overload.policy", "allow")
+	// also record why pods were not patched as an audit annotation, which
+	// adds one to the audit event of nearly every pod
+	cfg.SetDefault("admission.audit.skipped", false)
+	// how many patches of pod creations are kept for pods whose replicas
+	// get the same one; 0 disables the cache
+	cfg.SetDefault("patch.cache.size", 1024)
+	// timeouts of both listeners; writes must outlast the API server's
+	// longest webhook timeout of 30s
+	cfg.SetDefault("http.read.timeout", "10s")
+	cfg.SetDefault("http.write.timeout", "40s")
+	cfg.SetDefault("http.idle.timeout", "2m")
+
+	// create webhook.name and revert any edits to it; off so GitOps-managed
+	// configurations are not fought over
+	cfg.SetDefault("webhook.manage", false)
+	cfg.SetDefault("webhook.failure.policy", "Ignore")
+	cfg.SetDefault("webhook.reinvocation.policy", "Never")
+	cfg.SetDefault("webhook.timeout", "10s")
+	// only send pods labelled with microcumul.us/injectssl
+	cfg.SetDefault("webhook.label.selector", false)
+	// CA for the caBundle when not bootstrapping, e.g. a mounted ca.crt
+	cfg.SetDefault("webhook.ca.file", "")
+	// also register /workloads for the pod templates of Deployments,
+	// StatefulSets, DaemonSets and CronJobs
+	cfg.SetDefault("webhook.workloads", false)
+
+	// the downward API should provide POD_NAME and POD_NAMESPACE
+	cfg.SetDefault("pod.name", "")
+	cfg.SetDefault("pod.namespace", "")
+
+	// only one replica runs the reconciler; LEADER_ELECT=true or REPLICAS > 1
+	// enables it
+	cfg.SetDefault("leader.elect", false)
+	cfg.SetDefault("leader.elect.lease", "ca-injector")
+	cfg.SetDefault("replicas", 1)
+
+	// how often every pod is re-checked by the reconciler
+	cfg.SetDefault("reconcile.interval", "60s")
+	// how many namespaces are reconciled at once; each worker takes the
+	// pods of its share of the namespaces one after the other
+	cfg.SetDefault("reconcile.workers", 5)
+	// never mutated nor reconciled, in addition to the injector's own
+	// namespace
+	cfg.SetDefault("exclude.namespaces", "kube-system,kube-node-lease")
+	// comma-separated names or glob patterns; empty means all namespaces
+	cfg.SetDefault("reconcile.namespaces", "")
+	cfg.SetDefault("reconcile.exclude.namespaces", "")
+	// give the informer a chance to observe the mutated pod
+	cfg.SetDefault("reconcile.min.age", "60s")
+	// recover gradually rather than deleting everything at once
+	cfg.SetDefault("max.deletes.per.cycle", 10)
+	cfg.SetDefault("min.delete.interval", "2s")
+	// evict (respecting PodDisruptionBudgets) unless the cluster lacks the
+	// eviction subresource
+	cfg.SetDefault("reconcile.hard.delete", false)
+	// enforce, warn to only log and record events instead of deleting, or
+	// off to not run the reconciler at all
+	cfg.SetDefault("reconciler.mode", "enforce")
+	// record a CAInjected event on each newly injected pod
+	cfg.SetDefault("emit.events", false)
+	// bare pods are not recreated by anything once deleted
+	cfg.SetDefault("reconcile.delete.unmanaged", false)
+	// leave pods of DaemonSets alone, with an event on the DaemonSet; mirror
+	// pods are always left alone
+	cfg.SetDefault("reconcile.skip.daemonsets", true)
+
+	// base name of the injected volume; suffixed if the pod already has an
+	// unrelated volume of that name
+	cfg.SetDefault("volume.name", "microcumulus-injected-ssl")
+	// YAML file mapping container image patterns to the variables set in
+	// them
+	cfg.SetDefault("image.rules.file", "")
+	// octal defaultMode of the injected volume, e.g. 0444; empty leaves the
+	// API server's default of 0644
+	cfg.SetDefault("volume.default.mode", "")
+
+	// for pods in merge mode: the init container image, the system bundle in
+	// that image, and the system bundle in the app containers
+	cfg.SetDefault("merge.image", "alpine:3.18")
+	cfg.SetDefault("merge.source.path", "/etc/ssl/certs/ca-certificates.crt")
+	cfg.SetDefault("merge.target.path", "/etc/ssl/certs/ca-certificates.crt")
+
+	// namespace, or namespace,name for per-workload series
+	cfg.SetDefault("metric.labels", "namespace")
+
+	// injected for pods whose annotation value is "true"
+	cfg.SetDefault("default.ca.secret", "")
+	// pods without the annotation inherit that of their ReplicaSet,
+	// Deployment, StatefulSet, DaemonSet, Job or CronJob; needs permission
+	// to list them
+	cfg.SetDefault("owner.lookup", false)
+
+	// comma-separated namespaces or glob patterns pods may reference CA
+	// secrets from as namespace/name; empty disallows it
+	cfg.SetDefault("secret.source.namespaces", "")
+	// comma-separated host names or glob patterns microcumul.us/injectssl-url
+	// may fetch from; empty disables URLs
+	cfg.SetDefault("inline.url.hosts", "")
 
-	if err := cfg.ReadInConfig(); err != nil {
-		lg.WithError(err).Error("could not read initial config")
+	// resolve microcumul.us/injectssl-issuer through cert-manager CA issuers;
+	// ClusterIssuer secrets live in cert-manager's cluster resource namespace
+	cfg.SetDefault("cert.manager.issuers", false)
+	cfg.SetDefault("cert.manager.namespace", "cert-manager")
+
+	// support microcumul.us/injectssl-kube-root; caches the kube-root-ca.crt
+	// config map of every namespace
+	cfg.SetDefault("kube.root.bundles", false)
+
+	// resolve microcumul.us/injectssl-bundle through trust-manager Bundles
+	cfg.SetDefault("trust.manager.bundles", false)
+
+	// inject pods selected by CAInjectionPolicies which do not ask for a CA
+	// themselves
+	cfg.SetDefault("ca.injection.policies", false)
+
+	// regular expression the secret names pods pick must match, e.g.
+	// ^.*-ca$|^corp-ca$, and whether pods naming others are admitted
+	// without the CA and a warning (warn) or denied (deny); empty allows any
+	cfg.SetDefault("secret.name.pattern", "")
+	cfg.SetDefault("secret.name.policy", "warn")
+
+	// skip pods on Windows nodes with a warning, or inject the CA at a
+	// Windows path
+	cfg.SetDefault("windows.policy", "skip")
+	cfg.SetDefault("windows.mount.path", `C:\ssl`)
+
+	// warn or reject when the annotation references a missing secret
+	cfg.SetDefault("secret.missing.policy", "warn")
+	// mark the injected volume optional unless the pod's annotation says
+	// otherwise
+	cfg.SetDefault("secret.optional", false)
+
+	return cfg
+}
+
+// podNamespace returns the namespace the injector runs in, from POD_NAMESPACE
+// or the service account.
+func podNamespace(cfg *viper.Viper) string {
+	if ns := cfg.GetString("pod.namespace"); ns != "" {
+		return ns
 	}
+	bs, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil {
+		lg.WithError(err).Warn("could not determine own namespace")
+		return ""
+	}
+	return strings.TrimSpace(string(bs))
+}
 
-	cfg.OnConfigChange(func(_ fsnotify.Event) {
-		if err := cfg.ReadInConfig(); err != nil {
-			lg.WithError(err).Warn("could not reload config")
-		}
-	})
-	if os.Getenv("KUBERNETES_SERVICE_PORT") != "" {
+// setupLogging applies LOG_LEVEL and LOG_FORMAT to the logger.
+func setupLogging(cfg *viper.Viper) {
+	lvl, err := logrus.ParseLevel(cfg.GetString("log.level"))
+	if err != nil {
+		lg.WithError(err).Warn("invalid log level; using info")
+		lvl = logrus.InfoLevel
+	}
+	lg.SetLevel(lvl)
+
+	format := cfg.GetString("log.format")
+	if format == "" && os.Getenv("KUBERNETES_SERVICE_PORT") != "" {
+		format = "json"
+	}
+	switch format {
+	case "json":
 		lg.SetFormatter(&logrus.JSONFormatter{})
+	case "text", "":
+		lg.SetFormatter(&logrus.TextFormatter{})
+	default:
+		lg.WithField("format", format).Warn("unknown log format; using text")
+		lg.SetFormatter(&logrus.TextFormatter{})
 	}
+}
 
-	go cfg.WatchConfig()
+// auditMode reports whether the injector only observes, neither patching nor
+// deleting pods. Anything other than audit is treated as enforce.
+func auditMode(cfg *viper.Viper) bool {
+	return cfg.GetString("mode") == "audit"
+}
 
-	return cfg
+// reconcilerMode returns RECONCILER_MODE: enforce, warn to only log and
+// record events, or off. Anything else is treated as enforce.
+func reconcilerMode(cfg *viper.Viper) string {
+	switch m := cfg.GetString("reconciler.mode"); m {
+	case "warn", "off":
+		return m
+	}
+	return "enforce"
+}
+
+// observing reports whether the reconciler only reports what it would do, in
+// audit mode or with RECONCILER_MODE=warn. It then writes and deletes nothing,
+// not even secret copies.
+func observing(cfg *viper.Viper) bool {
+	return auditMode(cfg) || reconcilerMode(cfg) == "warn"
+}
+
+// setModeInfo exports the current mode as a metric.
+func setModeInfo(cfg *viper.Viper) {
+	mode := "enforce"
+	if auditMode(cfg) {
+		mode = "audit"
+	}
+	gaugeInfo.Reset()
+	gaugeInfo.WithLabelValues(mode).Set(1)
+	gaugeReconcilerInfo.Reset()
+	gaugeReconcilerInfo.WithLabelValues(reconcilerMode(cfg)).Set(1)
 }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// copySourceAnnotation holds the namespace/name of the secret a copy was
+	// made from.
+	copySourceAnnotation = "microcumul.us/secret-source"
+	// copyLabel marks secrets copied from another namespace, so they can be
+	// found and garbage collected.
+	copyLabel = "microcumul.us/secret-copy"
+)
+
+// splitSecretRef splits a namespace/name reference, defaulting to the given
+// namespace when the reference is a plain name.
+func splitSecretRef(namespace, ref string) (string, string) {
+	if i := strings.Index(ref, "/"); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return namespace, ref
+}
+
+// localSecretName is the name of the secret in the namespace holding the
+// referenced CA: the secret itself, or a copy for references to another
+// namespace.
+func localSecretName(namespace, ref string) string {
+	srcNs, name := splitSecretRef(namespace, ref)
+	if srcNs == namespace {
+		return name
+	}
+	return srcNs + "-" + name
+}
+
+// syncedSecrets names the secrets admitting or reconciling the pod writes
+// into its namespace: the local copy of its CA, unless that is the pod's own
+// secret, and the truststore, certificate directory or kube-root bundle
+// derived from it.
+func syncedSecrets(cfg *viper.Viper, pod corev1.Pod, secret string) []string {
+	var names []string
+	local := localSecretName(pod.Namespace, secret)
+	if srcNs, _ := splitSecretRef(pod.Namespace, secret); srcNs != pod.Namespace || issuerFor(cfg, pod) != "" || usesInline(secret, pod) {
+		names = append(names, local)
+	}
+	switch {
+	case wantsKubeRoot(pod):
+		names = append(names, kubeRootSecretName(local))
+	case wantsDir(pod):
+		names = append(names, certDirSecretName(local))
+	case wantsJava(pod):
+		names = append(names, truststoreSecretName(local))
+	}
+	return names
+}
+
+// sourceAllowed reports whether secrets may be copied from the namespace.
+// Without this any pod could read any secret in the cluster.
+func sourceAllowed(cfg *viper.Viper, namespace string) bool {
+	return matchAny(splitList(cfg.GetString("secret.source.namespaces")), namespace)
+}
+
+// syncSecretCopy makes sure the copy of a secret referenced from another
+// namespace exists in the namespace and carries the source's current ca.crt.
+// Only ca.crt is copied. Reads are served from the informer cache.
+func syncSecretCopy(ctx context.Context, cs kubernetes.Interface, sl corelisters.SecretLister, namespace, ref string) error {
+	srcNs, srcName := splitSecretRef(namespace, ref)
+	if srcNs == namespace {
+		return nil
+	}
+
+	src, err := sl.Secrets(srcNs).Get(srcName)
+	if err != nil {
+		return fmt.Errorf("error getting source secret %s/%s: %w", srcNs, srcName, err)
+	}
+	ca, ok := src.Data["ca.crt"]
+	if !ok {
+		return fmt.Errorf("source secret %s/%s has no ca.crt key", srcNs, srcName)
+	}
+
+	return writeCopy(ctx, cs, sl, namespace, localSecretName(namespace, ref), srcNs+"/"+srcName, nil, nil, map[string][]byte{
+		"ca.crt": ca,
+	})
+}
+
+// writeCopy creates or updates a secret derived from the source secret,
+// refusing to touch secrets it did not create. The extra labels are only set
+// when the secret is created.
+func writeCopy(ctx context.Context, cs kubernetes.Interface, sl corelisters.SecretLister, namespace, name, source string, extraLabels, annotations map[string]string, data map[string][]byte) error {
+	cur, err := sl.Secrets(namespace).Get(name)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error getting secret copy %s/%s: %w", namespace, name, err)
+	}
+	exists := err == nil
+	if exists {
+		if cur.Labels[copyLabel] != "true" {
+			return fmt.Errorf("secret %s/%s exists and is not managed by ca-injector", namespace, name)
+		}
+		if reflect.DeepEqual(cur.Data, data) && cur.Annotations[copySourceAnnotation] == source {
+			return nil
+		}
+	}
+
+	anns := map[string]string{
+		copySourceAnnotation: source,
+	}
+	for k, v := range annotations {
+		anns[k] = v
+	}
+
+	if !exists {
+		lbls := map[string]string{
+			"app.kubernetes.io/managed-by": "ca-injector",
+			copyLabel:                      "true",
+		}
+		for k, v := range extraLabels {
+			lbls[k] = v
+		}
+		_, err = cs.CoreV1().Secrets(namespace).Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   namespace,
+				Labels:      lbls,
+				Annotations: anns,
+			},
+			Data: data,
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("error creating secret copy %s/%s: %w", namespace, name, err)
+		}
+		return nil
+	}
+
+	cur = cur.DeepCopy()
+	cur.Data = data
+	if cur.Annotations == nil {
+		cur.Annotations = map[string]string{}
+	}
+	for k, v := range anns {
+		cur.Annotations[k] = v
+	}
+	_, err = cs.CoreV1().Secrets(namespace).Update(ctx, cur, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("error updating secret copy %s/%s: %w", namespace, name, err)
+	}
+	return nil
+}
+
+// copyKeyPrefix marks queue keys which refer to secret copies rather than
+// pods.
+const copyKeyPrefix = "secret:"
+
+// enqueueCopies queues every copy of the changed secret, so that copies follow
+// the source without waiting for the pods' resync.
+func (r *reconciler) enqueueCopies(obj interface{}) {
+	if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	src, ok := obj.(*corev1.Secret)
+	if !ok {
+		return
+	}
+
+	copies, err := r.secrets.List(labels.SelectorFromSet(labels.Set{copyLabel: "true"}))
+	if err != nil {
+		lg.WithError(err).Error("could not list secret copies")
+		return
+	}
+	for _, c := range copies {
+		if c.Annotations[copySourceAnnotation] == src.Namespace+"/"+src.Name {
+			r.requeue(copyKeyPrefix+c.Namespace+"/"+c.Name, 0)
+		}
+	}
+}
+
+// enqueueIssuerCopies queues every copy made from the changed issuer, which
+// may now point at a different secret.
+func (r *reconciler) enqueueIssuerCopies(ref string) {
+	copies, err := r.secrets.List(labels.SelectorFromSet(labels.Set{copyLabel: "true"}))
+	if err != nil {
+		lg.WithError(err).Error("could not list secret copies")
+		return
+	}
+	for _, c := range copies {
+		if ann := c.Annotations[copyIssuerAnnotation]; ann != "" && issuerSecretName(ann) == issuerSecretName(ref) {
+			r.requeue(copyKeyPrefix+c.Namespace+"/"+c.Name, 0)
+		}
+	}
+}
+
+// syncCopy refreshes a secret copy from its source. A copy whose source is
+// gone is kept, since pods still mount it, but the problem is surfaced on the
+// copy.
+func (r *reconciler) syncCopy(ctx context.Context, key string) error {
+	ns, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	if observing(r.cfg) {
+		lg.WithField("secret", key).Debug("audit or warn mode; not syncing secret copy")
+		return nil
+	}
+	c, err := r.secrets.Secrets(ns).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error getting secret copy from cache: %w", err)
+	}
+
+	if iss := c.Annotations[copyIssuerAnnotation]; iss != "" {
+		if r.issuers == nil {
+			return nil
+		}
+		return r.issuers.sync(ctx, r.cs, ns, iss)
+	}
+
+	ref := c.Annotations[copySourceAnnotation]
+	srcNs, srcName := splitSecretRef(ns, ref)
+	if _, err := r.secrets.Secrets(srcNs).Get(srcName); apierrors.IsNotFound(err) {
+		lg.WithField("secret", ns+"/"+name).WithField("source", ref).Warn("source of secret copy no longer exists")
+		ctrCopySourceMissing.WithLabelValues(ns).Inc()
+		r.recorder.Eventf(c, corev1.EventTypeWarning, "SourceSecretMissing",
+			"source secret %q no longer exists; pods keep using the last copied CA", ref)
+		return nil
+	}
+	if c.Annotations[certDirAnnotation] == "true" {
+		return syncCertDir(ctx, r.cs, r.secrets, srcNs, srcName)
+	}
+	if c.Annotations[kubeRootAnnotation] == "true" {
+		if kubeRootCAs == nil {
+			// Left as it is until KUBE_ROOT_BUNDLES is set again.
+			return nil
+		}
+		return syncKubeRootBundle(ctx, r.cs, r.secrets, srcNs, srcName)
+	}
+	if !sourceAllowed(r.cfg, srcNs) {
+		lg.WithField("secret", ns+"/"+name).WithField("source", ref).Warn("source namespace of secret copy is no longer allowed; not updating")
+		return nil
+	}
+	return syncSecretCopy(ctx, r.cs, r.secrets, ns, ref)
+}
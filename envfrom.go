@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// envFromLabel chooses what happens to the variables pointed at the CA which
+// a container also gets from envFrom: "override" them, since explicit env
+// entries win, or "keep" them.
+var envFromLabel = "microcumul.us/injectssl-envfrom"
+
+// configMapLister is set when config maps are cached anyway, for Bundles or
+// policies. envFrom config maps are only looked at then.
+var configMapLister corelisters.ConfigMapLister
+
+// envFromSources returns, for each container of the pod, the variables its
+// envFrom sources set and the source setting each. Sources which are not
+// cached or do not exist are left out; later ones win, like in the kubelet.
+func envFromSources(secrets corelisters.SecretLister, pod corev1.Pod) map[string]map[string]string {
+	ctrs := append(append([]corev1.Container(nil), pod.Spec.Containers...), pod.Spec.InitContainers...)
+	for _, ec := range pod.Spec.EphemeralContainers {
+		ctrs = append(ctrs, corev1.Container(ec.EphemeralContainerCommon))
+	}
+
+	out := map[string]map[string]string{}
+	for _, ctr := range ctrs {
+		for _, ef := range ctr.EnvFrom {
+			var (
+				keys []string
+				src  string
+			)
+			switch {
+			case ef.ConfigMapRef != nil && configMapLister != nil:
+				cm, err := configMapLister.ConfigMaps(pod.Namespace).Get(ef.ConfigMapRef.Name)
+				if err != nil {
+					continue
+				}
+				for k := range cm.Data {
+					keys = append(keys, k)
+				}
+				for k := range cm.BinaryData {
+					keys = append(keys, k)
+				}
+				src = fmt.Sprintf("config map %q", cm.Name)
+			case ef.SecretRef != nil && secrets != nil:
+				s, err := secrets.Secrets(pod.Namespace).Get(ef.SecretRef.Name)
+				if err != nil {
+					continue
+				}
+				for k := range s.Data {
+					keys = append(keys, k)
+				}
+				src = fmt.Sprintf("secret %q", s.Name)
+			default:
+				continue
+			}
+			if out[ctr.Name] == nil {
+				out[ctr.Name] = map[string]string{}
+			}
+			for _, k := range keys {
+				out[ctr.Name][ef.Prefix+k] = src
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+var (
+	pemLabel = "microcumul.us/injectssl-pem"
+	urlLabel = "microcumul.us/injectssl-url"
+)
+
+const (
+	// inlineLabel marks the secrets made from the CA of a pod's PEM or URL
+	// annotation, so those no pod references any more can be collected.
+	inlineLabel = "microcumul.us/inline-ca"
+
+	// inlineFetchTimeout bounds fetching a CA from a URL, which the
+	// reconciler does in the background.
+	inlineFetchTimeout = 5 * time.Second
+	// inlineMaxBytes limits what is read from a CA URL.
+	inlineMaxBytes = 1 << 20
+	// inlineGCGrace keeps unreferenced inline secrets for a while, since the
+	// pod they were made for may not be in the cache yet.
+	inlineGCGrace = 10 * time.Minute
+)
+
+// inlineSecretName returns the name of the secret holding the CA of the pod's
+// PEM or URL annotation, derived from the annotation so that pods giving the
+// same CA share a secret, or the empty string if the pod has neither.
+func inlineSecretName(pod corev1.Pod) string {
+	var src string
+	switch {
+	case annotation(pod.Annotations, pemLabel) != "":
+		src = strings.TrimSpace(annotation(pod.Annotations, pemLabel))
+	case annotation(pod.Annotations, urlLabel) != "":
+		src = "url:" + annotation(pod.Annotations, urlLabel)
+	default:
+		return ""
+	}
+	sum := sha256.Sum256([]byte(src))
+	return "ca-injector-" + hex.EncodeToString(sum[:8])
+}
+
+// usesInline reports whether the CA secret of the pod is the one made from
+// its PEM or URL annotation.
+func usesInline(secret string, pod corev1.Pod) bool {
+	return secret != "" && secret == inlineSecretName(pod)
+}
+
+// errInlineNotFetched is returned for URLs the reconciler has not fetched
+// into their secret yet.
+var errInlineNotFetched = errors.New("the CA has not been fetched yet; pods created once the injector has fetched it get the CA")
+
+// inlineCA returns the certificates of the pod's PEM annotation, or those its
+// URL served when the reconciler fetched it into its secret. URLs are never
+// fetched during admission; errInlineNotFetched is returned until the secret
+// exists.
+func inlineCA(cfg *viper.Viper, sl corelisters.SecretLister, pod corev1.Pod) ([]byte, error) {
+	if p := annotation(pod.Annotations, pemLabel); p != "" {
+		ca := []byte(strings.TrimSpace(p) + "\n")
+		if err := parseCertificates(ca); err != nil {
+			return nil, fmt.Errorf("%s: %w", pemLabel, err)
+		}
+		return ca, nil
+	}
+
+	if _, err := allowedURL(cfg, annotation(pod.Annotations, urlLabel)); err != nil {
+		return nil, fmt.Errorf("%s: %w", urlLabel, err)
+	}
+	if s, err := sl.Secrets(pod.Namespace).Get(inlineSecretName(pod)); err == nil && s.Labels[inlineLabel] == "true" && len(s.Data["ca.crt"]) > 0 {
+		return s.Data["ca.crt"], nil
+	}
+	return nil, fmt.Errorf("%s: %w", urlLabel, errInlineNotFetched)
+}
+
+// allowedURL parses a CA URL, which must be https and name one of
+// INLINE_URL_HOSTS. Without INLINE_URL_HOSTS no URL is allowed.
+func allowedURL(cfg *viper.Viper, raw string) (*url.URL, error) {
+	hosts := splitList(cfg.GetString("inline.url.hosts"))
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("CA URLs are disabled; set INLINE_URL_HOSTS to allow them")
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q: %w", raw, err)
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("URL %q is not https", raw)
+	}
+	if !matchAny(hosts, strings.ToLower(u.Hostname())) {
+		return nil, fmt.Errorf("host of URL %q is not in INLINE_URL_HOSTS", raw)
+	}
+	return u, nil
+}
+
+// publicAddress refuses connections to anything but public unicast
+// addresses. It checks the address a name resolved to, so no allowed name can
+// be pointed at the cluster, its nodes or the cloud's metadata service.
+func publicAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return fmt.Errorf("%q is not an IP address", host)
+	case ip.IsLoopback(), ip.IsPrivate(), ip.IsUnspecified(),
+		ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast(), ip.IsInterfaceLocalMulticast(), ip.IsMulticast(),
+		sharedAddressSpace.Contains(ip):
+		return fmt.Errorf("%s is not a public address", ip)
+	}
+	return nil
+}
+
+// sharedAddressSpace is 100.64.0.0/10, which some clusters use for pods and
+// services.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// fetchCA gets a PEM bundle from an allowed URL over HTTPS, trusting the
+// system's CAs only. Proxies are bypassed, as they would connect on the
+// injector's behalf, and redirects must stay within INLINE_URL_HOSTS.
+func fetchCA(ctx context.Context, cfg *viper.Viper, raw string) ([]byte, error) {
+	u, err := allowedURL(cfg, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:         (&net.Dialer{Timeout: inlineFetchTimeout, Control: publicAddress}).DialContext,
+			TLSHandshakeTimeout: inlineFetchTimeout,
+			DisableKeepAlives:   true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return fmt.Errorf("too many redirects")
+			}
+			_, err := allowedURL(cfg, req.URL.String())
+			return err
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, inlineFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching CA: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching CA from %q: %s", raw, res.Status)
+	}
+	ca, err := io.ReadAll(io.LimitReader(res.Body, inlineMaxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA from %q: %w", raw, err)
+	}
+	if len(ca) > inlineMaxBytes {
+		return nil, fmt.Errorf("CA from %q is larger than %d bytes", raw, inlineMaxBytes)
+	}
+	if err := parseCertificates(ca); err != nil {
+		return nil, fmt.Errorf("CA from %q: %w", raw, err)
+	}
+	return ca, nil
+}
+
+// parseCertificates verifies the PEM holds one or more certificates and
+// nothing else, so that e.g. a pasted private key never lands in a secret.
+func parseCertificates(bs []byte) error {
+	n := 0
+	for {
+		var blk *pem.Block
+		blk, bs = pem.Decode(bs)
+		if blk == nil {
+			break
+		}
+		if blk.Type != "CERTIFICATE" {
+			return fmt.Errorf("PEM holds a %q block; only certificates are allowed", blk.Type)
+		}
+		if _, err := x509.ParseCertificate(blk.Bytes); err != nil {
+			return fmt.Errorf("invalid certificate: %w", err)
+		}
+		n++
+	}
+	if n == 0 {
+		return fmt.Errorf("PEM holds no certificates")
+	}
+	if len(strings.TrimSpace(string(bs))) > 0 {
+		return fmt.Errorf("PEM has trailing data which is not a certificate")
+	}
+	return nil
+}
+
+// writeInline makes sure the pod's inline secret exists with the given CA.
+func writeInline(ctx context.Context, cs kubernetes.Interface, sl corelisters.SecretLister, pod corev1.Pod, ca []byte) error {
+	source := "pem"
+	if annotation(pod.Annotations, pemLabel) == "" {
+		source = annotation(pod.Annotations, urlLabel)
+	}
+	return writeCopy(ctx, cs, sl, pod.Namespace, inlineSecretName(pod), source, map[string]string{
+		inlineLabel: "true",
+	}, nil, map[string][]byte{
+		"ca.crt": ca,
+	})
+}
+
+// syncInline makes sure the pod's inline secret exists, fetching its URL if
+// it has not been yet.
+func syncInline(ctx context.Context, cfg *viper.Viper, cs kubernetes.Interface, sl corelisters.SecretLister, pod corev1.Pod) error {
+	ca, err := inlineCA(cfg, sl, pod)
+	if errors.Is(err, errInlineNotFetched) {
+		ca, err = fetchCA(ctx, cfg, annotation(pod.Annotations, urlLabel))
+		if err != nil {
+			err = fmt.Errorf("%s: %w", urlLabel, err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return writeInline(ctx, cs, sl, pod, ca)
+}
+
+// collectInline deletes the inline secrets in the reconciled namespaces which
+// no cached pod references and which are older than inlineGCGrace.
+func (r *reconciler) collectInline(ctx context.Context) {
+	secrets, err := r.secrets.List(labels.SelectorFromSet(labels.Set{inlineLabel: "true"}))
+	if err != nil {
+		lg.WithError(err).Error("could not list inline CA secrets")
+		return
+	}
+	for _, s := range secrets {
+		if !r.namespaces.allowed(s.Namespace) || time.Since(s.CreationTimestamp.Time) < inlineGCGrace {
+			continue
+		}
+		pods, err := r.podLister(s.Namespace).Pods(s.Namespace).List(labels.Everything())
+		if err != nil {
+			lg.WithError(err).Error("could not list cached pods")
+			return
+		}
+		used := false
+		for _, pod := range pods {
+			if inlineSecretName(*pod) == s.Name {
+				used = true
+				break
+			}
+		}
+		if used {
+			continue
+		}
+
+		if observing(r.cfg) {
+			lg.WithField("secret", s.Namespace+"/"+s.Name).Info("audit or warn mode; would delete inline CA secret no pod references")
+			continue
+		}
+		uid := s.UID
+		err = r.cs.CoreV1().Secrets(s.Namespace).Delete(ctx, s.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &uid},
+		})
+		if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+			continue
+		}
+		if err != nil {
+			lg.WithError(err).WithField("secret", s.Namespace+"/"+s.Name).Error("could not delete unreferenced inline CA secret")
+			continue
+		}
+		lg.WithField("secret", s.Namespace+"/"+s.Name).Info("deleted inline CA secret no pod references")
+	}
+}
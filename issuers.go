@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var issuerLabel = "microcumul.us/injectssl-issuer"
+
+// copyIssuerAnnotation holds the issuer reference a copy was resolved from.
+const copyIssuerAnnotation = "microcumul.us/issuer-source"
+
+var (
+	issuerGVR        = schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "issuers"}
+	clusterIssuerGVR = schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "clusterissuers"}
+)
+
+// issuerResolver finds the CA certificate of cert-manager CA issuers from
+// informer caches.
+type issuerResolver struct {
+	factory        dynamicinformer.DynamicSharedInformerFactory
+	issuers        cache.GenericLister
+	clusterIssuers cache.GenericLister
+	secrets        corelisters.SecretLister
+	// clusterNs is cert-manager's cluster resource namespace, where the
+	// secrets of ClusterIssuers live.
+	clusterNs string
+}
+
+// newIssuerResolver registers informers for Issuers and ClusterIssuers with a
+// new factory, which must be started afterwards.
+func newIssuerResolver(dyn dynamic.Interface, secrets corelisters.SecretLister, cfg *viper.Viper) *issuerResolver {
+	f := dynamicinformer.NewDynamicSharedInformerFactory(dyn, 10*time.Minute)
+	return &issuerResolver{
+		factory:        f,
+		issuers:        f.ForResource(issuerGVR).Lister(),
+		clusterIssuers: f.ForResource(clusterIssuerGVR).Lister(),
+		secrets:        secrets,
+		clusterNs:      cfg.GetString("cert.manager.namespace"),
+	}
+}
+
+// onChange calls fn with the reference of every issuer which changes.
+func (ir *issuerResolver) onChange(fn func(ref string)) {
+	for kind, gvr := range map[string]schema.GroupVersionResource{"issuer": issuerGVR, "clusterissuer": clusterIssuerGVR} {
+		kind := kind
+		ir.factory.ForResource(gvr).Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(_, obj interface{}) {
+				if u, ok := obj.(*unstructured.Unstructured); ok {
+					fn(kind + "/" + u.GetName())
+				}
+			},
+		})
+	}
+}
+
+// issuerFor returns the issuer reference the pod asks for, if issuer support
+// is enabled and the pod does not name a secret itself.
+func issuerFor(cfg *viper.Viper, pod corev1.Pod) string {
+	if !cfg.GetBool("cert.manager.issuers") || requestedSecret(pod) != "" {
+		return ""
+	}
+	return annotation(pod.Annotations, issuerLabel)
+}
+
+// splitIssuerRef splits an issuer/name or clusterissuer/name reference; a
+// plain name refers to an Issuer.
+func splitIssuerRef(ref string) (kind, name string) {
+	if i := strings.Index(ref, "/"); i >= 0 {
+		return strings.ToLower(ref[:i]), ref[i+1:]
+	}
+	return "issuer", ref
+}
+
+// issuerSecretName is the name of the ca.crt-only secret maintained in each
+// namespace using the issuer.
+func issuerSecretName(ref string) string {
+	kind, name := splitIssuerRef(ref)
+	return kind + "-" + name + "-ca"
+}
+
+// resolve returns the namespace and name of the CA secret behind the issuer.
+func (ir *issuerResolver) resolve(namespace, ref string) (string, string, error) {
+	kind, name := splitIssuerRef(ref)
+
+	var (
+		obj runtime.Object
+		err error
+	)
+	secretNs := namespace
+	switch kind {
+	case "issuer":
+		obj, err = ir.issuers.ByNamespace(namespace).Get(name)
+	case "clusterissuer":
+		obj, err = ir.clusterIssuers.Get(name)
+		secretNs = ir.clusterNs
+	default:
+		return "", "", fmt.Errorf("unknown issuer kind %q in %q; use issuer/<name> or clusterissuer/<name>", kind, ref)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("error getting %s: %w", ref, err)
+	}
+
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return "", "", fmt.Errorf("unexpected type %T for %s", obj, ref)
+	}
+	secret, found, err := unstructured.NestedString(u.Object, "spec", "ca", "secretName")
+	if err != nil || !found || secret == "" {
+		return "", "", fmt.Errorf("%s is not a CA issuer", ref)
+	}
+	return secretNs, secret, nil
+}
+
+// check verifies the issuer resolves to a secret holding a CA certificate,
+// returning the certificate and the secret's namespace/name. CA secrets
+// written by cert-manager carry ca.crt; for self-signed roots tls.crt is the
+// CA itself.
+func (ir *issuerResolver) check(namespace, ref string) ([]byte, string, error) {
+	srcNs, srcName, err := ir.resolve(namespace, ref)
+	if err != nil {
+		return nil, "", err
+	}
+	src, err := ir.secrets.Secrets(srcNs).Get(srcName)
+	if err != nil {
+		return nil, "", fmt.Errorf("error getting CA secret %s/%s of %s: %w", srcNs, srcName, ref, err)
+	}
+	ca := src.Data["ca.crt"]
+	if len(ca) == 0 {
+		ca = src.Data["tls.crt"]
+	}
+	if len(ca) == 0 {
+		return nil, "", fmt.Errorf("CA secret %s/%s of %s has neither ca.crt nor tls.crt", srcNs, srcName, ref)
+	}
+	return ca, srcNs + "/" + srcName, nil
+}
+
+// sync makes sure the namespace has an up to date ca.crt-only copy of the
+// issuer's CA. The issuer's private key is never copied.
+func (ir *issuerResolver) sync(ctx context.Context, cs kubernetes.Interface, namespace, ref string) error {
+	ca, source, err := ir.check(namespace, ref)
+	if err != nil {
+		return err
+	}
+	return writeCopy(ctx, cs, ir.secrets, namespace, issuerSecretName(ref), source, nil, map[string]string{
+		copyIssuerAnnotation: ref,
+	}, map[string][]byte{
+		"ca.crt": ca,
+	})
+}
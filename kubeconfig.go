@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var kubeconfig = pflag.String("kubeconfig", "", "kubeconfig to use when not running in a cluster; defaults to $KUBECONFIG or ~/.kube/config")
+
+// kubeConfig returns the in-cluster config or, outside a cluster, the one
+// from --kubeconfig, KUBECONFIG or ~/.kube/config, and where it came from.
+// Outside a cluster, the kubeconfig context's namespace stands in for
+// POD_NAMESPACE unless that is set.
+func kubeConfig(cfg *viper.Viper) (*rest.Config, string, error) {
+	if *kubeconfig == "" {
+		conf, err := rest.InClusterConfig()
+		if err == nil {
+			return conf, "in-cluster", nil
+		}
+		if !errors.Is(err, rest.ErrNotInCluster) {
+			return nil, "", err
+		}
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = *kubeconfig
+	cc := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
+	conf, err := cc.ClientConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	if cfg.GetString("pod.namespace") == "" {
+		if ns, _, err := cc.Namespace(); err == nil {
+			cfg.Set("pod.namespace", ns)
+		}
+	}
+	return conf, "kubeconfig " + first(*kubeconfig, os.Getenv("KUBECONFIG"), clientcmd.RecommendedHomeFile), nil
+}
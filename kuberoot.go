@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+
+	"github.com/microcumulus/ca-injector/mutate"
+)
+
+var kubeRootLabel = "microcumul.us/injectssl-kube-root"
+
+// kubeRootAnnotation marks the secrets holding a CA bundled with the
+// cluster's.
+const kubeRootAnnotation = "microcumul.us/kube-root-bundle"
+
+// kubeRootCAs caches the kube-root-ca.crt config map of every namespace, if
+// KUBE_ROOT_BUNDLES is set.
+var kubeRootCAs corelisters.ConfigMapLister
+
+// kubeRootSyncTimeout bounds the wait for the kube-root-ca.crt cache at
+// startup.
+const kubeRootSyncTimeout = 30 * time.Second
+
+// newKubeRootFactory registers an informer for just the kube-root-ca.crt
+// config maps with a new factory, which must be started afterwards.
+func newKubeRootFactory(cs kubernetes.Interface) informers.SharedInformerFactory {
+	f := informers.NewSharedInformerFactoryWithOptions(cs, 10*time.Minute, informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+		o.FieldSelector = "metadata.name=" + mutate.KubeRootConfigMap
+	}))
+	kubeRootCAs = f.Core().V1().ConfigMaps().Lister()
+	return f
+}
+
+// startKubeRoot starts the factory and waits up to kubeRootSyncTimeout for
+// its cache. Until it syncs, bundles cannot be written.
+func startKubeRoot(ctx context.Context, f informers.SharedInformerFactory) {
+	f.Start(ctx.Done())
+	syncCtx, cancel := context.WithTimeout(ctx, kubeRootSyncTimeout)
+	defer cancel()
+	for typ, ok := range f.WaitForCacheSync(syncCtx.Done()) {
+		if !ok {
+			lg.WithField("type", typ.String()).Error("could not sync kube-root-ca.crt cache; is the injector allowed to list config maps? Bundles are not written until it syncs")
+		}
+	}
+}
+
+// wantsKubeRoot reports whether the pod asked for its CA bundled with the
+// cluster's, for workloads talking to the API server as well. Without
+// KUBE_ROOT_BUNDLES the annotation is ignored.
+func wantsKubeRoot(pod corev1.Pod) bool {
+	return kubeRootCAs != nil && annotation(pod.Annotations, kubeRootLabel) == "true"
+}
+
+// kubeRootSecretName is the name of the secret derived from a CA secret which
+// holds its ca.crt followed by the cluster's CA.
+func kubeRootSecretName(secret string) string {
+	return secret + "-kube-root"
+}
+
+// syncKubeRootBundle makes sure the derived bundle secret for the given CA
+// secret exists in the namespace, holding its ca.crt and then the namespace's
+// kube-root-ca.crt. The order never changes, so neither does the bundle while
+// its sources do not. Reads are served from the informer caches.
+func syncKubeRootBundle(ctx context.Context, cs kubernetes.Interface, sl corelisters.SecretLister, namespace, secret string) error {
+	src, err := sl.Secrets(namespace).Get(secret)
+	if err != nil {
+		return fmt.Errorf("error getting source secret %s/%s: %w", namespace, secret, err)
+	}
+	ca, ok := src.Data["ca.crt"]
+	if !ok {
+		return fmt.Errorf("source secret %s/%s has no ca.crt", namespace, secret)
+	}
+	if kubeRootCAs == nil {
+		return fmt.Errorf("kube-root-ca.crt config maps are not cached")
+	}
+	root, err := kubeRootCAs.ConfigMaps(namespace).Get(mutate.KubeRootConfigMap)
+	if err != nil {
+		return fmt.Errorf("error getting %s/%s: %w", namespace, mutate.KubeRootConfigMap, err)
+	}
+
+	var bundle bytes.Buffer
+	bundle.Write(bytes.TrimSpace(ca))
+	bundle.WriteByte('\n')
+	bundle.WriteString(strings.TrimSpace(root.Data["ca.crt"]))
+	bundle.WriteByte('\n')
+
+	return writeCopy(ctx, cs, sl, namespace, kubeRootSecretName(secret), namespace+"/"+secret, nil, map[string]string{
+		kubeRootAnnotation: "true",
+	}, map[string][]byte{
+		mutate.KubeRootBundleFile: bundle.Bytes(),
+	})
+}
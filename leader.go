@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// leaderElect reports whether leader election is enabled, either explicitly
+// or because more than one replica is configured.
+func leaderElect(cfg *viper.Viper) bool {
+	return cfg.GetBool("leader.elect") || cfg.GetInt("replicas") > 1
+}
+
+// runLeader calls fn whenever this replica holds the leader lease, cancelling
+// its context when leadership is lost, until ctx is cancelled. Without leader
+// election fn simply runs until ctx is cancelled.
+func runLeader(ctx context.Context, cs kubernetes.Interface, cfg *viper.Viper, fn func(ctx context.Context)) {
+	if !leaderElect(cfg) {
+		gaugeLeader.Set(1)
+		fn(ctx)
+		return
+	}
+
+	id := cfg.GetString("pod.name")
+	if id == "" {
+		id, _ = os.Hostname()
+	}
+	lg := lg.WithField("identity", id)
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      cfg.GetString("leader.elect.lease"),
+			Namespace: podNamespace(cfg),
+		},
+		Client: cs.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: id,
+		},
+	}
+
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			ReleaseOnCancel: true,
+			LeaseDuration:   15 * time.Second,
+			RenewDeadline:   10 * time.Second,
+			RetryPeriod:     2 * time.Second,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					lg.Info("acquired leadership")
+					gaugeLeader.Set(1)
+					fn(ctx)
+				},
+				OnStoppedLeading: func() {
+					lg.Info("lost leadership")
+					gaugeLeader.Set(0)
+				},
+				OnNewLeader: func(leader string) {
+					lg.WithField("leader", leader).Info("observed leader")
+				},
+			},
+		})
+	}
+}
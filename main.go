@@ -3,27 +3,32 @@ package main
 import (
 	"context"
 	"crypto/x509"
-	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
-	admv1 "k8s.io/api/admission/v1"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
+
+	"github.com/microcumulus/ca-injector/mutate"
 )
 
 func secsSince(t time.Time) float64 {
@@ -39,268 +44,637 @@ func first(ss ...string) string {
 	return ""
 }
 
-const (
-	label      = "microcumul.us/injectssl"
-	volumeName = "microcumulus-injected-ssl"
-)
+var (
+	label = "microcumul.us/injectssl"
 
-type p struct {
-	Op    string      `json:"op"`
-	Path  string      `json:"path"`
-	Value interface{} `json:"value,omitempty"`
-}
-type m map[string]interface{}
+	overrideEnvLabel = "microcumul.us/injectssl-override-env"
+	optionalLabel    = "microcumul.us/injectssl-optional"
+	modeLabel        = "microcumul.us/injectssl-mode"
+	mergePathLabel   = "microcumul.us/injectssl-merge-path"
+	modeBitsLabel    = "microcumul.us/injectssl-mode-bits"
+)
 
-var (
-	ctrDeletes = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "ca_injector_pods_deleted",
-		Help: "The number of pods deleted by the ca-injector pod",
-	}, []string{"namespace", "name"})
-
-	ctrPatches = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "ca_injector_pods_mutated",
-		Help: "The number of pods mutated by the ca-injector webhook",
-	}, []string{"namespace", "name"})
+const (
+	// maxWarnings and maxWarningLen keep admission warnings readable in
+	// kubectl output.
+	maxWarnings   = 10
+	maxWarningLen = 200
 )
 
+// shuttingDown is set once a termination signal is received, failing /readyz.
+var shuttingDown int32
+
 func main() {
+	pflag.Parse()
 	cfg := setupConfig()
+	if err := setAnnotationPrefix(cfg); err != nil {
+		lg.WithError(err).Fatal("invalid annotation prefix")
+	}
+	if _, err := regexp.Compile(cfg.GetString("secret.name.pattern")); err != nil {
+		lg.WithError(err).Fatal("invalid SECRET_NAME_PATTERN")
+	}
+	switch *components {
+	case "webhook", "reconciler", "all":
+	default:
+		lg.WithField("components", *components).Fatal("--components must be webhook, reconciler or all")
+	}
+	v := currentVersion()
+	lg.WithFields(logrus.Fields{
+		"version":    v.Version,
+		"commit":     v.Commit,
+		"buildDate":  v.BuildDate,
+		"goVersion":  v.GoVersion,
+		"components": *components,
+	}).Info("starting ca-injector")
+	gaugeBuildInfo.WithLabelValues(v.Version, v.Commit).Set(1)
+	setModeInfo(cfg)
+	patches.reset(cfg.GetInt("patch.cache.size"))
+	if auditMode(cfg) {
+		lg.Warn("running in audit mode; pods are neither patched nor deleted")
+	} else {
+		lg.Info("running in enforce mode")
+	}
+
+	if f := cfg.GetString("image.rules.file"); f != "" {
+		var err error
+		if imageRules, err = loadImageRules(f); err != nil {
+			lg.WithError(err).Fatal("could not load image rules")
+		}
+		lg.WithField("rules", len(imageRules)).Info("loaded image rules")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	f, err := os.OpenFile(cfg.GetString("tls.crt"), os.O_RDONLY, 0400)
+	shutdownTracing, err := setupTracing(ctx)
 	if err != nil {
-		lg.WithError(err).Fatal("could not read tls cert for serving and to check expiry")
+		lg.WithError(err).Fatal("could not set up tracing")
 	}
 
-	cert, err := getFirstExpiringCert(f)
+	conf, source, err := kubeConfig(cfg)
 	if err != nil {
-		lg.WithError(err).Fatal("could not read cert end date for certificate")
+		lg.WithError(err).Fatal("could not load kubernetes client config")
 	}
-	go func() {
-		time.Sleep(time.Until(cert.NotAfter))
-		ioutil.WriteFile("/dev/termination-log", []byte("shutting down due to expired certificate, hoping it has been refreshed"), 0600)
-		lg.Fatal("cert expired; shutting down")
-	}()
+	lg.WithField("source", source).Info("loaded kubernetes client config")
+	if source != "in-cluster" && runsReconciler() && reconcilerMode(cfg) == "enforce" {
+		lg.Warn("running outside a cluster with the reconciler enforcing; set RECONCILER_MODE=off to only serve the webhook")
+	}
+	traceAPICalls(conf)
+	cs := kubernetes.NewForConfigOrDie(conf)
+
+	var (
+		certs *certReloader
+		boot  *bootstrapper
+	)
+	switch {
+	case !runsWebhook():
+		// Nothing to serve but metrics.
+	case cfg.GetBool("insecure.http"):
+	case !fileExists(cfg.GetString("tls.cert.file")) && cfg.GetBool("bootstrap.cert"):
+		certs = &certReloader{}
+		boot = newBootstrapper(cs, certs, cfg)
+		if err := boot.ensure(ctx); err != nil {
+			lg.WithError(err).Fatal("could not bootstrap serving certificate; set BOOTSTRAP_CERT=false and provide TLS_CERT_FILE and TLS_KEY_FILE instead")
+		}
+		go boot.run(ctx)
+	default:
+		for _, f := range []string{cfg.GetString("tls.cert.file"), cfg.GetString("tls.key.file")} {
+			if _, err := os.Stat(f); err != nil {
+				lg.WithError(err).WithField("file", f).Fatal("tls file for serving does not exist; set TLS_CERT_FILE and TLS_KEY_FILE, or INSECURE_HTTP=true behind a TLS-terminating proxy")
+			}
+		}
 
-	http.Handle("/metrics", promhttp.Handler())
-	http.Handle("/pods", admitFunc(func(ar admv1.AdmissionReview) (res *admv1.AdmissionResponse, err error) {
-		var pod corev1.Pod
-		obj, _, err := codecs.UniversalDeserializer().Decode(ar.Request.Object.Raw, nil, &pod)
+		certs, err = newCertReloader(cfg.GetString("tls.cert.file"), cfg.GetString("tls.key.file"))
 		if err != nil {
+			lg.WithError(err).Fatal("could not load tls keypair for serving")
+		}
+		go certs.watch(ctx)
+	}
+	if certs != nil {
+		go func() {
+			for {
+				time.Sleep(time.Until(certs.notAfter()))
+				if time.Now().Before(certs.notAfter()) {
+					// reloaded in the meantime
+					continue
+				}
+				ioutil.WriteFile("/dev/termination-log", []byte("shutting down due to expired certificate, hoping it has been refreshed"), 0600)
+				lg.Fatal("cert expired; shutting down")
+			}
+		}()
+	}
+
+	// caBundle returns the CA the webhook configurations should hold, if the
+	// injector knows it.
+	caBundle := func() []byte {
+		if boot != nil {
+			return boot.caBundle()
+		}
+		if f := cfg.GetString("webhook.ca.file"); f != "" {
+			bs, err := ioutil.ReadFile(f)
 			if err != nil {
-				lg.WithError(err).Error("could not deserialize pod spec")
-				return nil, err
+				lg.WithError(err).WithField("file", f).Warn("could not read webhook CA; keeping current caBundle")
 			}
+			return bs
 		}
+		return nil
+	}
+	if cfg.GetBool("webhook.manage") && runsWebhook() {
+		go newWebhookManager(cs, cfg, caBundle).run(ctx)
+	}
+
+	factory := informers.NewSharedInformerFactory(cs, 10*time.Minute)
+	secrets := factory.Core().V1().Secrets().Lister()
+	namespaceLister = factory.Core().V1().Namespaces().Lister()
+	var kubeRoot informers.SharedInformerFactory
+	if cfg.GetBool("kube.root.bundles") {
+		kubeRoot = newKubeRootFactory(cs)
+	}
 
-		lg := lg.WithFields(logrus.Fields{
-			"ar.Request.Name":                        ar.Request.Name,
-			"ar.Request.Namespace":                   ar.Request.Namespace,
-			"pod.Name":                               pod.Name,
-			"pod.Namespace":                          pod.Namespace,
-			"pod.CreationTimestamp":                  pod.CreationTimestamp.Time,
-			"obj.GetObjectKind().GroupVersionKind()": obj.GetObjectKind().GroupVersionKind(),
-		})
-
-		if pod.Annotations[label] == "" {
-			lg.Info("allowing")
-			return &admv1.AdmissionResponse{
-				Allowed: true,
-			}, nil
+	var issuers *issuerResolver
+	if cfg.GetBool("cert.manager.issuers") {
+		issuers = newIssuerResolver(dynamic.NewForConfigOrDie(conf), secrets, cfg)
+	}
+	var bundles *bundleResolver
+	if cfg.GetBool("trust.manager.bundles") {
+		bundles = newBundleResolver(dynamic.NewForConfigOrDie(conf), factory)
+	}
+	if cfg.GetBool("ca.injection.policies") {
+		policies = newPolicyResolver(dynamic.NewForConfigOrDie(conf), factory)
+	}
+	if bundles != nil || policies != nil {
+		configMapLister = factory.Core().V1().ConfigMaps().Lister()
+	}
+	if cfg.GetBool("owner.lookup") {
+		owners = newOwnerResolver(cs)
+	}
+
+	// Metrics and health are served in plain text on their own listener so
+	// they can be scraped without the webhook's CA; the webhook is only ever
+	// served on the TLS listener.
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", promhttp.Handler())
+	metricsMux.HandleFunc("/version", serveVersion)
+	metricsMux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	metricsMux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if atomic.LoadInt32(&shuttingDown) == 1 {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
 		}
-		lg.Info("will patch")
-
-		var patch []p
-		if pod.Spec.Volumes == nil {
-			patch = append(patch, p{
-				Op:    "add",
-				Path:  "/spec/volumes",
-				Value: []interface{}{}, // add array if none
-			})
+		if atomic.LoadInt32(&selfCheckFailing) == 1 {
+			http.Error(w, "self-check failing", http.StatusServiceUnavailable)
+			return
 		}
+		io.WriteString(w, "ok")
+	})
+
+	if cfg.GetBool("enable.pprof") {
+		// e.g. go tool pprof http://localhost:9090/debug/pprof/heap after
+		// kubectl port-forward to the metrics port.
+		metricsMux.HandleFunc("/debug/pprof/", pprof.Index)
+		metricsMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		metricsMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		metricsMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		metricsMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		lg.Warn("serving pprof on the metrics listener")
+	}
+
+	ownNs := podNamespace(cfg)
+	var slots chan struct{}
+	if n := cfg.GetInt("admission.max.concurrent"); n > 0 {
+		slots = make(chan struct{}, n)
+	}
+	mutating := admitHandler{
+		defaultTimeout:  cfg.GetDuration("webhook.timeout"),
+		margin:          cfg.GetDuration("admission.timeout.margin"),
+		denyOnTimeout:   cfg.GetString("admission.timeout.policy") == "deny",
+		maxBodyBytes:    cfg.GetInt64("admission.max.body.bytes"),
+		slots:           slots,
+		queueTimeout:    cfg.GetDuration("admission.queue.timeout"),
+		errorOnOverload: cfg.GetString("admission.overload.policy") == "error",
+		auditSkips:      cfg.GetBool("admission.audit.skipped"),
+	}
+	admitPod := admitPods(cfg, cs, secrets, issuers, bundles, ownNs)
+	mux := http.NewServeMux()
+	mux.Handle("/pods", mutating.with(admitPod))
+	mux.Handle("/workloads", mutating.with(admitWorkloads(admitPod)))
+
+	mux.Handle("/validate", admitHandler{
+		defaultTimeout:  cfg.GetDuration("webhook.timeout"),
+		margin:          cfg.GetDuration("admission.timeout.margin"),
+		maxBodyBytes:    cfg.GetInt64("admission.max.body.bytes"),
+		slots:           slots,
+		queueTimeout:    cfg.GetDuration("admission.queue.timeout"),
+		errorOnOverload: cfg.GetString("admission.overload.policy") == "error",
+	}.with(validatePods(cfg, secrets, issuers, bundles, ownNs)))
+
+	// Without the reconciler nothing lists or deletes pods, so the webhook
+	// needs no permissions on them.
+	var rec *reconciler
+	if runsReconciler() && reconcilerMode(cfg) != "off" {
+		rec = newReconciler(cs, factory, issuers, bundles, cfg)
+		lg.WithField("mode", reconcilerMode(cfg)).Info("reconciler mode")
+		metricsMux.HandleFunc("/report", rec.serveReport)
+	}
 
-		// TODO add documentation that the secret needs to have `ca.crt` key/value
-		patch = append(patch, p{
-			Op:   "add",
-			Path: "/spec/volumes/-",
-			Value: m{
-				"name": volumeName,
-				"secret": m{
-					"secretName": pod.Annotations[label],
-				},
-			},
-		})
-
-		for i, ctr := range pod.Spec.Containers {
-			ps := []p{{
-				Op:   "add",
-				Path: fmt.Sprintf("/spec/containers/%d/env/-", i),
-				Value: m{
-					"name":  "SSL_CERT_FILE",
-					"value": "/ssl/ca.crt",
-				},
-			}, {
-				Op:   "add",
-				Path: fmt.Sprintf("/spec/containers/%d/env/-", i),
-				Value: m{
-					"name":  "NODE_EXTRA_CA_CERTS",
-					"value": "/ssl/ca.crt",
-				},
-			}, {
-				Op:   "add",
-				Path: fmt.Sprintf("/spec/containers/%d/volumeMounts/-", i),
-				Value: m{
-					"name":      volumeName,
-					"mountPath": "/ssl",
-					"readOnly":  true,
-				},
-			}}
-
-			if ctr.Env == nil {
-				ps = append([]p{{
-					Op:    "add",
-					Path:  fmt.Sprintf("/spec/containers/%d/env", i),
-					Value: []interface{}{}, //add the array if none
-				}}, ps...)
+	factory.Start(ctx.Done())
+	for typ, ok := range factory.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			lg.WithField("type", typ.String()).Fatal("could not sync informer cache")
+		}
+	}
+	if kubeRoot != nil {
+		startKubeRoot(ctx, kubeRoot)
+	}
+	if owners != nil {
+		owners.start(ctx)
+	}
+	if issuers != nil {
+		issuers.factory.Start(ctx.Done())
+		for gvr, ok := range issuers.factory.WaitForCacheSync(ctx.Done()) {
+			if !ok {
+				lg.WithField("resource", gvr.String()).Fatal("could not sync cert-manager issuer cache; are the cert-manager CRDs installed?")
 			}
-			if len(ctr.VolumeMounts) == 0 {
-				ps = append([]p{{
-					Op:    "add",
-					Path:  fmt.Sprintf("/spec/containers/%d/volumeMounts", i),
-					Value: []interface{}{}, //add the array if none
-				}}, ps...)
+		}
+	}
+	if bundles != nil {
+		bundles.factory.Start(ctx.Done())
+		for gvr, ok := range bundles.factory.WaitForCacheSync(ctx.Done()) {
+			if !ok {
+				lg.WithField("resource", gvr.String()).Fatal("could not sync trust-manager bundle cache; are the trust-manager CRDs installed?")
 			}
-
-			patch = append(patch, ps...)
 		}
+	}
+	if policies != nil {
+		policies.factory.Start(ctx.Done())
+		for gvr, ok := range policies.factory.WaitForCacheSync(ctx.Done()) {
+			if !ok {
+				lg.WithField("resource", gvr.String()).Fatal("could not sync CA injection policy cache; is the CAInjectionPolicy CRD installed?")
+			}
+		}
+	}
 
-		ctrPatches.WithLabelValues(pod.Namespace, pod.Name).Inc()
-		lg.WithField("patch", patch).Info("patching")
-
-		bs, _ := json.Marshal(patch)
+	recDone := make(chan struct{})
+	go func() {
+		defer close(recDone)
+		if rec == nil {
+			return
+		}
+		// Give the webhook a chance to start serving so deleted pods are
+		// recreated with the CA injected.
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return
+		}
+		runLeader(ctx, cs, cfg, rec.Run)
+	}()
 
-		pt := admv1.PatchTypeJSONPatch
-		return &admv1.AdmissionResponse{
-			Allowed:   true,
-			Patch:     bs,
-			PatchType: &pt,
-			Result: &metav1.Status{
-				Message: "modified",
-			},
-		}, nil
-	}))
+	s := http.Server{
+		Addr:         cfg.GetString("listen.addr"),
+		Handler:      withRequestID(mux),
+		ReadTimeout:  cfg.GetDuration("http.read.timeout"),
+		WriteTimeout: cfg.GetDuration("http.write.timeout"),
+		IdleTimeout:  cfg.GetDuration("http.idle.timeout"),
+	}
+	if certs != nil {
+		tc, policy, err := serverTLSConfig(cfg, certs)
+		if err != nil {
+			lg.WithError(err).Fatal("invalid TLS settings")
+		}
+		s.TLSConfig = tc
+		lg.WithField("policy", policy).Info("webhook TLS policy")
+	}
 
-	conf, err := rest.InClusterConfig()
-	if err != nil {
-		log.Fatal(err)
+	ms := http.Server{
+		Addr:         cfg.GetString("metrics.addr"),
+		Handler:      withRequestID(metricsMux),
+		ReadTimeout:  cfg.GetDuration("http.read.timeout"),
+		WriteTimeout: cfg.GetDuration("http.write.timeout"),
+		IdleTimeout:  cfg.GetDuration("http.idle.timeout"),
 	}
 
+	shutdownDone := make(chan struct{})
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
 	go func() {
-		time.Sleep(5 * time.Second)
-
-		f := false
-		for {
-			if f {
-				time.Sleep(60 * time.Second)
+		i := 0
+		for range ch {
+			i++
+			if i > 1 {
+				os.Exit(1)
 			}
-			f = true
+			go func() {
+				defer close(shutdownDone)
+				shutdown(cfg, cancel, &s, &ms)
+			}()
+		}
+	}()
 
-			ctx := context.TODO()
-			cs := kubernetes.NewForConfigOrDie(conf)
-			pods, err := cs.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
-			if err != nil {
-				logrus.WithError(err).Fatal("error listing pods")
-			}
+	go func() {
+		lg.WithField("addr", ms.Addr).Info("serving metrics")
+		if err := ms.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			lg.WithError(err).Fatal("could not serve metrics")
+		}
+	}()
 
-			lg.WithField("len(pods.Items)", len(pods.Items)).Info("got pod list")
-
-		items:
-			for _, pod := range pods.Items {
-				lg := lg.WithFields(logrus.Fields{
-					"pod.Name":      pod.Name,
-					"pod.Namespace": pod.Namespace,
-				})
-
-				or := corev1.ObjectReference{
-					Kind:            pod.Kind,
-					Namespace:       pod.Namespace,
-					Name:            pod.Name,
-					UID:             pod.UID,
-					APIVersion:      pod.APIVersion,
-					ResourceVersion: pod.ResourceVersion,
-				}
+	switch {
+	case !runsWebhook() || cfg.GetDuration("selfcheck.interval") <= 0:
+	case cfg.GetString("tls.client.ca.file") != "":
+		lg.Info("not self-checking the webhook, which requires client certificates")
+	default:
+		sc := &selfChecker{cs: cs, cfg: cfg, tls: certs != nil, caBundle: caBundle}
+		go sc.run(ctx)
+	}
 
-				if len(pod.OwnerReferences) > 0 {
-					or = corev1.ObjectReference{
-						Kind:       pod.OwnerReferences[0].Kind,
-						Namespace:  pod.Namespace,
-						Name:       pod.OwnerReferences[0].Name,
-						UID:        pod.OwnerReferences[0].UID,
-						APIVersion: pod.OwnerReferences[0].APIVersion,
-					}
-				}
+	// Started last, as everything above reads the settings without cfgMu.
+	publishSettings(cfg)
+	go watchConfig(ctx, cfg)
+
+	switch {
+	case !runsWebhook():
+		lg.Info("not serving the webhook with --components=reconciler")
+		<-ctx.Done()
+	case certs == nil:
+		lg.WithField("addr", s.Addr).Info("listening")
+		lg.Warn("serving plain HTTP; TLS must be terminated in front of the injector")
+		err = s.ListenAndServe()
+	default:
+		lg.WithField("addr", s.Addr).Info("listening")
+		err = s.ListenAndServeTLS("", "")
+	}
+	if runsWebhook() && err != http.ErrServerClosed {
+		lg.WithError(err).Fatal("could not serve webhook")
+	}
 
-				secret := pod.Annotations[label]
-				if secret == "" {
-					lg.Debug("did not find annotation " + label)
-					continue
-				}
+	<-shutdownDone
+	select {
+	case <-recDone:
+	case <-time.After(cfg.GetDuration("shutdown.timeout")):
+		lg.Warn("reconciler did not stop in time")
+	}
 
-				// Look for well-known volume in list of mounts
-				for _, vol := range pod.Spec.Volumes {
-					if vol.Secret != nil && vol.Secret.SecretName == secret && vol.Name == volumeName {
-						lg.Debug("found volume matching secret from annotation")
-						continue items
-					}
-				}
+	flushCtx, done := context.WithTimeout(context.Background(), 5*time.Second)
+	defer done()
+	if err := shutdownTracing(flushCtx); err != nil {
+		lg.WithError(err).Warn("could not flush traces")
+	}
+	lg.Info("shut down")
+}
 
-				lg.Info("deleting pod; CA mount not found")
-
-				_, err = cs.CoreV1().Events(pod.Namespace).Create(ctx, &corev1.Event{
-					ObjectMeta: metav1.ObjectMeta{
-						GenerateName: "ca-injector-delete-",
-					},
-					LastTimestamp:       metav1.Now(),
-					ReportingController: "ca-injector",
-					InvolvedObject:      or,
-					Reason:              "CertAuthorityMissing",
-					Message:             fmt.Sprintf("pod annotation on %q has not been applied by ca-injector mutatingadmissionwebhook; pod will be deleted", pod.Name),
-					Type:                "Warning",
-				}, metav1.CreateOptions{})
-				if err != nil {
-					lg.WithError(err).Error("error generating pod deletion event")
-				}
+// shutdown withdraws readiness, waits for the endpoints to be updated so the
+// API server stops sending admissions, then drains in-flight requests,
+// closing connections forcibly once the timeout passes.
+func shutdown(cfg *viper.Viper, cancel context.CancelFunc, servers ...*http.Server) {
+	lg.Info("shutting down")
+	atomic.StoreInt32(&shuttingDown, 1)
 
-				ctrDeletes.WithLabelValues(pod.Namespace, pod.Name).Inc()
+	// Cancelling stops the reconciler and releases the leader lease, if held.
+	cancel()
 
-				err := cs.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
-				if err != nil {
-					logrus.WithError(err).WithField("pod", pod.Name).Error("error deleting pod")
-				}
+	time.Sleep(cfg.GetDuration("shutdown.delay"))
+
+	ctx, done := context.WithTimeout(context.Background(), cfg.GetDuration("shutdown.timeout"))
+	defer done()
+	for _, s := range servers {
+		if err := s.Shutdown(ctx); err != nil {
+			lg.WithError(err).WithField("addr", s.Addr).Warn("could not drain connections in time; closing")
+			s.Close()
+		}
+	}
+}
+
+// mutateConfig resolves how the CA is injected into the pod. bundles may be
+// nil if Bundle support is disabled.
+func mutateConfig(cfg *viper.Viper, bundles *bundleResolver, pod corev1.Pod) mutate.Config {
+	mcfg := linuxConfig(cfg, bundles, pod)
+	if windowsPod(pod) {
+		windowsConfig(cfg, &mcfg)
+	}
+	return mcfg
+}
+
+// linuxConfig resolves how the CA is injected into the pod on Linux.
+func linuxConfig(cfg *viper.Viper, bundles *bundleResolver, pod corev1.Pod) mutate.Config {
+	mcfg := mutate.Config{
+		SecretName:  injectedSecretName(cfg, pod),
+		VolumeName:  cfg.GetString("volume.name"),
+		Optional:    optional(cfg, pod),
+		OverrideEnv: annotation(pod.Annotations, overrideEnvLabel) == "true",
+		KeepEnvFrom: annotation(pod.Annotations, envFromLabel) == "keep",
+	}
+	_, mcfg.Source = resolveSecret(cfg, pod)
+	mcfg.DefaultMode, _ = defaultMode(cfg, pod)
+	mcfg.Key, _ = secretKey(cfg, pod)
+	mcfg.Rules = imageRules
+	p := policyFor(cfg, pod)
+	if p != nil {
+		mcfg.MountPath = p.spec.MountPath
+		if len(p.spec.Env) > 0 {
+			mcfg.Rules = policyRules(p)
+		}
+	}
+	if annotation(pod.Annotations, modeLabel) == "env" {
+		// No files to point anything else at; just the PEM itself.
+		mcfg.Env = true
+		if wantsDir(pod) {
+			mcfg.Key = certDirBundleKey
+		}
+	}
+	if annotation(pod.Annotations, modeLabel) == "merge" {
+		mcfg.Merge = &mutate.Merge{
+			Image:      cfg.GetString("merge.image"),
+			SourcePath: cfg.GetString("merge.source.path"),
+			TargetPath: first(annotation(pod.Annotations, mergePathLabel), cfg.GetString("merge.target.path")),
+		}
+	}
+	if b := bundleFor(cfg, pod); b != "" && bundles != nil {
+		// Java truststores are only built from secrets.
+		mcfg.SecretName = ""
+		mcfg.Source = "bundle"
+		if t, err := bundles.target(b); err == nil {
+			mcfg.Key = t.key
+			if t.configMap {
+				mcfg.ConfigMapName = b
+			} else {
+				mcfg.SecretName = b
 			}
 		}
-	}()
+		return mcfg
+	}
+	if cm := policyConfigMap(cfg, pod); cm != "" {
+		mcfg.SecretName = ""
+		mcfg.ConfigMapName = cm
+		mcfg.Key = p.spec.ConfigMap.Key
+		return mcfg
+	}
+	if mcfg.Env {
+		return mcfg
+	}
+	if wantsDir(pod) {
+		mcfg.Dir = true
+		return mcfg
+	}
+	if wantsKubeRoot(pod) {
+		mcfg.KubeRootBundle = kubeRootSecretName(localSecretName(pod.Namespace, secretName(cfg, pod)))
+		return mcfg
+	}
+	if wantsJava(pod) {
+		mcfg.JavaToolOptions = javaToolOptions(first(mcfg.MountPath, mutate.MountPath))
+	}
+	return mcfg
+}
 
-	s := http.Server{
-		Addr:    ":8443",
-		Handler: http.DefaultServeMux,
+// windowsConfig moves what mcfg injects to WINDOWS_MOUNT_PATH for pods on
+// Windows. The merge init container needs sh, so none is added.
+func windowsConfig(cfg *viper.Viper, mcfg *mutate.Config) {
+	mcfg.Windows = true
+	mcfg.Merge = nil
+	if mcfg.MountPath == "" {
+		mcfg.MountPath = cfg.GetString("windows.mount.path")
+	}
+	if mcfg.JavaToolOptions != "" {
+		mcfg.JavaToolOptions = javaToolOptions(mcfg.MountPath)
 	}
+}
 
-	ch := make(chan os.Signal, 2)
-	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
-	go func() {
-		i := 0
-		for range ch {
-			i++
-			if i > 1 {
-				os.Exit(1)
+// skipPod records why the webhook lets the pod through without the CA, in
+// ca_injector_pods_skipped_total unless it is a dry run, and in the
+// admission's reason. The reason must be one of a fixed set; lg identifies the
+// pod.
+func skipPod(ctx context.Context, lg logrus.FieldLogger, reason string, dryRun bool) {
+	lg.WithField("skipReason", reason).Debug("not injecting the CA")
+	if !dryRun {
+		ctrPodsSkipped.WithLabelValues(reason).Inc()
+	}
+	setReason(ctx, reason, false)
+}
+
+// defaultMode returns the defaultMode for the injected volume from the pod's
+// annotation or VOLUME_DEFAULT_MODE, or nil for the API server's default. An
+// invalid value is reported and ignored.
+func defaultMode(cfg *viper.Viper, pod corev1.Pod) (*int32, error) {
+	v, src := annotation(pod.Annotations, modeBitsLabel), modeBitsLabel
+	if v == "" {
+		v, src = cfg.GetString("volume.default.mode"), "VOLUME_DEFAULT_MODE"
+	}
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(v, 8, 32)
+	if err != nil || n < 0 || n > 0777 {
+		return nil, fmt.Errorf("%s %q is not an octal file mode between 0000 and 0777; using the default", src, v)
+	}
+	mode := int32(n)
+	return &mode, nil
+}
+
+// optional reports whether the injected volume should be optional, from the
+// pod's annotation or else SECRET_OPTIONAL.
+func optional(cfg *viper.Viper, pod corev1.Pod) bool {
+	if v, ok := lookupAnnotation(pod.Annotations, optionalLabel); ok {
+		return v == "true"
+	}
+	return cfg.GetBool("secret.optional")
+}
+
+// annotationWarnings flags annotations and labels under our prefix that are
+// not recognized, which are usually typos.
+func annotationWarnings(pod corev1.Pod) []string {
+	known := knownKeys()
+	prefix := strings.SplitN(label, "/", 2)[0] + "/"
+	defaultPrefix := mutate.DefaultAnnotationPrefix + "/"
+
+	var warnings []string
+	for _, kv := range []map[string]string{pod.Annotations, pod.Labels} {
+		for k := range kv {
+			switch {
+			case strings.HasPrefix(k, prefix) && !known[k]:
+				warnings = append(warnings, fmt.Sprintf("%q is not recognized by ca-injector and is ignored", k))
+			case prefix == defaultPrefix || !strings.HasPrefix(k, defaultPrefix) || !known[prefix+strings.TrimPrefix(k, defaultPrefix)]:
+			case legacyPrefix != "":
+				warnings = append(warnings, fmt.Sprintf("%q is deprecated; use %q", k, prefix+strings.TrimPrefix(k, defaultPrefix)))
+			default:
+				warnings = append(warnings, fmt.Sprintf("%q is ignored; ca-injector reads %q", k, prefix+strings.TrimPrefix(k, defaultPrefix)))
 			}
-			s.Shutdown(context.Background())
 		}
-	}()
+	}
+	if kubeRootCAs == nil && annotation(pod.Annotations, kubeRootLabel) == "true" {
+		warnings = append(warnings, fmt.Sprintf("%q needs KUBE_ROOT_BUNDLES=true; the CA is injected without the cluster's", kubeRootLabel))
+	}
+	sort.Strings(warnings)
+	return warnings
+}
 
-	lg.Info("listening")
+// legacyKeys returns the annotations and labels of the pod which are only
+// honored under the legacy prefix.
+func legacyKeys(pod corev1.Pod) []string {
+	if legacyPrefix == "" {
+		return nil
+	}
+	known := knownKeys()
+	prefix := strings.SplitN(label, "/", 2)[0]
+	var keys []string
+	for _, kv := range []map[string]string{pod.Annotations, pod.Labels} {
+		for k := range kv {
+			if strings.HasPrefix(k, legacyPrefix+"/") && known[prefix+strings.TrimPrefix(k, legacyPrefix)] {
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// knownKeys returns the annotations and labels the injector reads from or
+// writes to pods.
+func knownKeys() map[string]bool {
+	return map[string]bool{
+		label:                true,
+		overrideEnvLabel:     true,
+		optionalLabel:        true,
+		javaLabel:            true,
+		issuerLabel:          true,
+		bundleLabel:          true,
+		modeLabel:            true,
+		mergePathLabel:       true,
+		modeBitsLabel:        true,
+		dirLabel:             true,
+		restartOnRotateLabel: true,
+		pemLabel:             true,
+		urlLabel:             true,
+		envFromLabel:         true,
+		kubeRootLabel:        true,
+		keyLabel:             true,
+
+		mutate.InjectedAnnotation:       true,
+		mutate.InjectedSecretAnnotation: true,
+		mutate.InjectedHashAnnotation:   true,
+		mutate.InjectedSourceAnnotation: true,
+
+		mutate.InjectedTemplateAnnotation: true,
+	}
+}
+
+// capWarnings truncates overly long warnings and limits how many are returned.
+func capWarnings(warnings []string) []string {
+	if len(warnings) > maxWarnings {
+		n := len(warnings) - maxWarnings + 1
+		warnings = append(warnings[:maxWarnings-1:maxWarnings-1], fmt.Sprintf("and %d more warnings", n))
+	}
+	for i, w := range warnings {
+		if len(w) > maxWarningLen {
+			warnings[i] = w[:maxWarningLen-3] + "..."
+		}
+	}
+	return warnings
+}
 
-	lg.Fatal(s.ListenAndServeTLS(cfg.GetString("tls.crt"), cfg.GetString("tls.key")))
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
 }
 
 func getFirstExpiringCert(r io.Reader) (*x509.Certificate, error) {
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/microcumulus/ca-injector/mutate"
+)
+
+func TestMain(m *testing.M) {
+	lg.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// testCA is a self-signed certificate for secrets that must hold a valid CA.
+const testCA = `-----BEGIN CERTIFICATE-----
+MIIBejCCASGgAwIBAgIULezZ6laKj6vmaXecd8aTJouST/YwCgYIKoZIzj0EAwIw
+EjEQMA4GA1UEAwwHdGVzdCBjYTAgFw0yNjEwMTQxNDM0MDlaGA8yMTI2MDkyMDE0
+MzQwOVowEjEQMA4GA1UEAwwHdGVzdCBjYTBZMBMGByqGSM49AgEGCCqGSM49AwEH
+A0IABFIFUvvjJBGLRhAnU+xCj7iKhvlsDRIoHdHC+VfWpfmgQXhBcGlzjjxx1GCo
+R9i7qRb+3x6yhvCSatDJb/SZ4fyjUzBRMB0GA1UdDgQWBBRSG5/h056aYvgesFwR
+na1aTpfn+zAfBgNVHSMEGDAWgBRSG5/h056aYvgesFwRna1aTpfn+zAPBgNVHRMB
+Af8EBTADAQH/MAoGCCqGSM49BAMCA0cAMEQCIFlayyFGwMQH5Ul17Pyz1y+Fi/u5
+1YWnVdixAEIlF8T/AiBBu8vAspmhU8O7i6EukxRdGcmEv7FmEcUz0Uq+X1ffZg==
+-----END CERTIFICATE-----
+`
+
+// testPod returns a pod of a ReplicaSet in namespace team, created an hour
+// ago, with the given annotations.
+func testPod(name string, annotations map[string]string) corev1.Pod {
+	controller := true
+	return corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "team",
+			UID:               types.UID("uid-" + name),
+			ResourceVersion:   "1",
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-time.Hour)),
+			Annotations:       annotations,
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1",
+				Kind:       "ReplicaSet",
+				Name:       "web-abc",
+				UID:        "uid-web-abc",
+				Controller: &controller,
+			}},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "nginx"}},
+		},
+	}
+}
+
+// testSecret returns a CA secret in the namespace.
+func testSecret(namespace, name string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       namespace,
+			ResourceVersion: "1",
+		},
+		Data: map[string][]byte{"ca.crt": []byte(testCA)},
+	}
+}
+
+// applyPatch returns the pod with the JSON patch applied.
+func applyPatch(t *testing.T, pod corev1.Pod, patch []byte) corev1.Pod {
+	t.Helper()
+	p, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		t.Fatalf("decoding patch %s: %v", patch, err)
+	}
+	bs, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs, err = p.Apply(bs); err != nil {
+		t.Fatalf("applying patch %s: %v", patch, err)
+	}
+	var out corev1.Pod
+	if err := json.Unmarshal(bs, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// injectedPod returns the pod as the webhook would have admitted it.
+func injectedPod(t *testing.T, pod corev1.Pod, secret string) corev1.Pod {
+	t.Helper()
+	patch, _, err := mutate.BuildPatch(pod, mutate.Config{SecretName: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := json.Marshal(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return applyPatch(t, pod, bs)
+}
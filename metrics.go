@@ -0,0 +1,220 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	ctrDeletes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ca_injector_pods_deleted",
+		Help: "The number of pods deleted by the ca-injector pod",
+	}, []string{"namespace", "name"})
+
+	ctrPodsSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ca_injector_pods_skipped_total",
+		Help: "The number of pods the webhook let through without injecting the CA, by reason",
+	}, []string{"reason"})
+
+	ctrReconcileSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ca_injector_reconcile_skipped_total",
+		Help: "The number of non-compliant pods the reconciler left alone, by reason",
+	}, []string{"reason"})
+
+	ctrEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ca_injector_pod_evictions_total",
+		Help: "The number of pod evictions attempted by the ca-injector pod, by result (evicted or blocked by a disruption budget)",
+	}, []string{"namespace", "result"})
+
+	ctrDeletesDeferred = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ca_injector_deletes_deferred_total",
+		Help: "The number of pod deletions deferred to a later cycle by the deletion budget",
+	}, []string{"namespace"})
+
+	ctrUnmanaged = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ca_injector_pods_uninjected_unmanaged",
+		Help: "The number of times the reconciler found an uninjected pod without a controller and left it alone",
+	}, []string{"namespace"})
+
+	ctrCopySourceMissing = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ca_injector_secret_copy_source_missing_total",
+		Help: "The number of times a secret copied from another namespace was found to have lost its source",
+	}, []string{"namespace"})
+
+	ctrReconcileExamined = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ca_injector_reconcile_pods_examined_total",
+		Help: "The number of pod keys the reconciler looked at, including repeats",
+	})
+
+	ctrReconcileDeletions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ca_injector_reconcile_deletions_total",
+		Help: "The number of deletions or evictions of non-compliant pods the reconciler attempted, by result (succeeded, failed, blocked by a disruption budget, or conflict when the pod changed since it was judged)",
+	}, []string{"result"})
+
+	histReconcilePass = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ca_injector_reconcile_duration_seconds",
+		Help:    "Time from the reconciler's queue filling up until it drained again",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+	})
+
+	ctrReconcileErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ca_injector_reconcile_errors_total",
+		Help: "The number of failed reconciles, by kind of key (pod or copy); failed keys are retried with backoff",
+	}, []string{"kind"})
+
+	gaugeLastReconcile = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ca_injector_last_successful_reconcile_timestamp",
+		Help: "Unix time at which the reconciler last handled a key without error, or started",
+	})
+
+	ctrAdmissionRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ca_injector_admission_requests_total",
+		Help: "The number of admission requests, by operation, decision (allowed, patched, denied, errored or skipped) and reason",
+	}, []string{"operation", "decision", "reason"})
+
+	ctrDecodeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ca_injector_admission_decode_errors_total",
+		Help: "The number of admission reviews (review) or their objects (object) which could not be decoded, usually from API version skew",
+	}, []string{"what"})
+
+	ctrSelfCheckFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ca_injector_selfcheck_failures_total",
+		Help: "The number of self-checks of the webhook which failed",
+	})
+
+	ctrAdmissionTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ca_injector_admission_deadline_exceeded_total",
+		Help: "The number of admissions answered without a patch because the handler did not finish before the API server's timeout",
+	})
+
+	histAdmission = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "ca_injector_admission_duration_seconds",
+		Help: "Time taken to handle pod admissions, by outcome (allowed, patched, denied or errored)",
+	}, []string{"outcome"})
+
+	histPatchOps = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ca_injector_patch_operations",
+		Help:    "The number of JSON patch operations generated per pod admission",
+		Buckets: []float64{0, 1, 2, 4, 8, 16, 32, 64, 128},
+	})
+
+	gaugeAdmissionsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ca_injector_admissions_in_flight",
+		Help: "The number of admission handlers currently running, including those whose request was already answered",
+	})
+
+	ctrAdmissionShed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ca_injector_admission_shed_total",
+		Help: "The number of admissions answered without running the handler because ADMISSION_MAX_CONCURRENT handlers were already running",
+	})
+
+	gaugeCertExpiry = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ca_injector_tls_cert_expiry_timestamp",
+		Help: "Unix time at which the first certificate of the serving chain expires",
+	})
+
+	gaugeLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ca_injector_is_leader",
+		Help: "Whether this replica is currently running the reconciler",
+	})
+
+	gaugeInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ca_injector_info",
+		Help: "Always 1; the mode label reports whether the injector enforces or only audits",
+	}, []string{"mode"})
+
+	ctrSecretDisallowed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ca_injector_secret_disallowed_total",
+		Help: "The number of pods admitted naming a secret SECRET_NAME_PATTERN does not allow, by namespace",
+	}, []string{"namespace"})
+
+	ctrPatchCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ca_injector_patch_cache_lookups_total",
+		Help: "The number of pod creations looked up in the patch cache, by result (hit or miss)",
+	}, []string{"result"})
+
+	gaugePatchCacheEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ca_injector_patch_cache_entries",
+		Help: "The number of patches in the patch cache",
+	})
+
+	gaugeConfigHash = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ca_injector_config_hash",
+		Help: "Always 1; the hash label identifies the config file generation in effect, or is none without a file",
+	}, []string{"hash"})
+
+	ctrConfigReloadErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ca_injector_config_reload_errors_total",
+		Help: "The number of changed config files which were invalid and not applied",
+	})
+
+	gaugeBuildInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ca_injector_build_info",
+		Help: "Always 1; the labels report the version and commit of the running build",
+	}, []string{"version", "commit"})
+
+	gaugeReconcilerInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ca_injector_reconciler_info",
+		Help: "Always 1; the mode label reports whether the reconciler deletes (enforce), only warns (warn) or is off",
+	}, []string{"mode"})
+
+	gaugeNoncompliant = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ca_injector_pods_noncompliant",
+		Help: "The number of pods the reconciler last saw requesting the CA without having it injected",
+	}, []string{"namespace"})
+
+	ctrWouldMutate = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ca_injector_pods_would_mutate",
+		Help: "The number of pods the ca-injector webhook would have mutated in audit mode",
+	}, []string{"namespace", "name"})
+
+	ctrPatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ca_injector_pods_mutated",
+		Help: "The number of pods mutated by the ca-injector webhook",
+	}, []string{"namespace", "name"})
+
+	ctrSecretMissing = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ca_injector_secret_missing_total",
+		Help: "The number of admissions referencing a missing or incomplete CA secret",
+	}, []string{"namespace"})
+)
+
+// podMetricLabels returns the namespace and name label values for the
+// per-pod counters. Unless METRIC_LABELS includes name, the name is left empty
+// so there is one series per namespace; when it is included the name is taken
+// from the pod's owner rather than the generated pod name, to keep it stable
+// across restarts.
+func podMetricLabels(cfg *viper.Viper, pod corev1.Pod) []string {
+	if !metricLabelEnabled(cfg, "name") {
+		return []string{pod.Namespace, ""}
+	}
+	return []string{pod.Namespace, ownerName(pod)}
+}
+
+func metricLabelEnabled(cfg *viper.Viper, name string) bool {
+	for _, l := range splitList(cfg.GetString("metric.labels")) {
+		if l == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ownerName returns a stable name for the workload the pod belongs to,
+// stripping the pod-template-hash so that pods of a Deployment all map to the
+// Deployment's name.
+func ownerName(pod corev1.Pod) string {
+	owner := metav1.GetControllerOf(&pod)
+	if owner == nil {
+		return first(pod.GenerateName, pod.Name)
+	}
+	if hash := pod.Labels["pod-template-hash"]; owner.Kind == "ReplicaSet" && hash != "" {
+		return strings.TrimSuffix(owner.Name, "-"+hash)
+	}
+	return owner.Name
+}
@@ -0,0 +1,1127 @@
+// Package mutate builds the JSON patch that injects a CA secret into a pod.
+package mutate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// DefaultVolumeName is the name of the injected volume unless configured
+	// otherwise.
+	DefaultVolumeName = "microcumulus-injected-ssl"
+	// MountPath is where the injected volume is mounted in every container
+	// unless configured otherwise.
+	MountPath = "/ssl"
+	// CAFile is the path of the CA bundle inside the containers at the
+	// default MountPath.
+	CAFile = MountPath + "/ca.crt"
+	// DirBundleFile is the key holding all certificates concatenated in
+	// secrets mounted as a directory.
+	DirBundleFile = "bundle.pem"
+	// KubeRootConfigMap is the config map in every namespace holding the
+	// cluster's CA, which is mounted as KubeRootFile alongside ca.crt when
+	// Config.KubeRootBundle is set.
+	KubeRootConfigMap = "kube-root-ca.crt"
+	KubeRootFile      = "kube-root-ca.crt"
+	// KubeRootBundleFile is the key of Config.KubeRootBundle holding ca.crt
+	// followed by the cluster's CA, which the variables point at.
+	KubeRootBundleFile = "bundle.crt"
+	// PEMEnv is the variable holding the CA itself in env mode.
+	PEMEnv = "CA_CERT_PEM"
+	// JavaToolOptions is the variable the truststore options are added to.
+	JavaToolOptions = "JAVA_TOOL_OPTIONS"
+)
+
+// DefaultAnnotationPrefix is the domain of the marker annotations unless
+// SetAnnotationPrefix moves them.
+const DefaultAnnotationPrefix = "microcumul.us"
+
+var (
+	// InjectedAnnotation is set to "true" on pods the CA was injected into,
+	// and InjectedSecretAnnotation to the secret or config map injected.
+	InjectedAnnotation       = DefaultAnnotationPrefix + "/injected"
+	InjectedSecretAnnotation = DefaultAnnotationPrefix + "/injected-secret"
+	// InjectedHashAnnotation records Config.CAHash, and
+	// InjectedSourceAnnotation Config.Source, when set.
+	InjectedHashAnnotation   = DefaultAnnotationPrefix + "/injected-ca-hash"
+	InjectedSourceAnnotation = DefaultAnnotationPrefix + "/injected-secret-source"
+	// InjectedTemplateAnnotation is set to "true" on the pod templates of
+	// workloads the CA was injected into, and so on the pods made from them.
+	InjectedTemplateAnnotation = DefaultAnnotationPrefix + "/injected-template"
+)
+
+// SetAnnotationPrefix moves the marker annotations to another domain. It must
+// be called before any pod is patched.
+func SetAnnotationPrefix(prefix string) {
+	for _, k := range []*string{&InjectedAnnotation, &InjectedSecretAnnotation, &InjectedHashAnnotation, &InjectedSourceAnnotation, &InjectedTemplateAnnotation} {
+		*k = prefix + (*k)[strings.Index(*k, "/"):]
+	}
+}
+
+// Rule chooses the variables set in containers by their image.
+type Rule struct {
+	// Name identifies the rule in logs.
+	Name string
+	// Image is matched against the container's image; nil matches any
+	// image, for a default rule.
+	Image *regexp.Regexp
+	// Env lists the variables to set. SSL_CERT_DIR is pointed at the mount,
+	// JAVA_TOOL_OPTIONS gets the truststore options, and anything else,
+	// e.g. SSL_CERT_FILE or REQUESTS_CA_BUNDLE, is pointed at the CA file.
+	Env []string
+}
+
+// Sets reports whether the rule sets the named variable.
+func (r Rule) Sets(name string) bool {
+	for _, n := range r.Env {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchRule returns the first rule matching the image, or nil.
+func MatchRule(rules []Rule, image string) *Rule {
+	for i, r := range rules {
+		if r.Image == nil || r.Image.MatchString(image) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+const (
+	// MergeContainerName is the name of the init container merging the CA
+	// into the system bundle.
+	MergeContainerName = "ca-injector-merge"
+	mergeDir           = "/merged"
+	mergeFile          = "ca-certificates.crt"
+)
+
+// PatchOp is a single JSON patch operation.
+type PatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+type m map[string]interface{}
+
+// Config holds what the caller resolved from the pod and the injector's
+// settings.
+type Config struct {
+	// SecretName is the secret mounted as the injected volume.
+	SecretName string
+	// ConfigMapName is mounted instead of a secret if set.
+	ConfigMapName string
+	// Key is the key holding the CA bundle, if not ca.crt.
+	Key string
+	// VolumeName is the base name of the injected volume; DefaultVolumeName
+	// if empty.
+	VolumeName string
+	// MountPath is where the volume is mounted; MountPath if empty.
+	MountPath string
+	// Optional marks the secret volume optional, so the pod starts even if
+	// the secret does not exist yet.
+	Optional bool
+	// DefaultMode, if set, is the file mode of the files in the volume.
+	DefaultMode *int32
+	// OverrideEnv replaces env vars the containers already set to something
+	// other than CAFile; otherwise they are left alone with a warning.
+	OverrideEnv bool
+	// JavaToolOptions, if set, is added to JAVA_TOOL_OPTIONS in every
+	// container, or with Rules, in those whose rule lists JAVA_TOOL_OPTIONS.
+	JavaToolOptions string
+	// Rules, if set, choose the variables of each container by its image.
+	// Containers matching none get the variables of the mode.
+	Rules []Rule
+	// Dir mounts every key of the secret and points SSL_CERT_DIR at them
+	// instead of SSL_CERT_FILE at ca.crt. The secret must hold all
+	// certificates concatenated under DirBundleFile for Node.
+	Dir bool
+	// Merge, if set, adds an init container which appends the CA to a
+	// system bundle and mounts the result over the containers' bundle,
+	// instead of replacing the trust store with SSL_CERT_FILE.
+	Merge *Merge
+	// Env sets PEMEnv in every container from the secret or config map's key
+	// instead of mounting a volume, for containers which may not have
+	// volumes. Nothing else is injected.
+	Env bool
+	// CAHash, if set, is recorded in InjectedHashAnnotation so the pod can be
+	// told apart from pods injected with another version of the CA.
+	CAHash string
+	// Source, if set, is recorded in InjectedSourceAnnotation to tell where
+	// the injected secret's name came from.
+	Source string
+	// EnvFrom holds, by container name, the variables the containers get from
+	// envFrom and where from, to warn about those the injected ones
+	// override. With KeepEnvFrom they are left alone instead.
+	EnvFrom     map[string]map[string]string
+	KeepEnvFrom bool
+	// KubeRootBundle, if set, is the secret holding KubeRootBundleFile. The
+	// volume is then projected from the secret's ca.crt, KubeRootConfigMap
+	// and the bundle.
+	KubeRootBundle string
+	// Windows joins the paths the variables point at with backslashes, for
+	// Windows containers; MountPath should be a Windows path then.
+	Windows bool
+}
+
+// Merge configures the merge init container.
+type Merge struct {
+	// Image provides sh, cat and the system bundle at SourcePath.
+	Image      string
+	SourcePath string
+	// TargetPath is the system bundle in the app containers.
+	TargetPath string
+}
+
+type envVar struct {
+	name, value string
+}
+
+// envVarsFor returns the variables pointed at the CA in the container, from
+// its rule if there is one.
+func (cfg Config) envVarsFor(ctr corev1.Container) []envVar {
+	rule := MatchRule(cfg.Rules, ctr.Image)
+	if rule == nil {
+		return cfg.envVars()
+	}
+	var out []envVar
+	for _, name := range rule.Env {
+		switch name {
+		case JavaToolOptions:
+			// Appended separately, if the truststore is mounted.
+		case "SSL_CERT_DIR":
+			out = append(out, envVar{name, cfg.mountPath()})
+		default:
+			out = append(out, envVar{name, cfg.caFile()})
+		}
+	}
+	return out
+}
+
+// javaFor reports whether JavaToolOptions apply to the container.
+func (cfg Config) javaFor(ctr corev1.Container) bool {
+	if cfg.JavaToolOptions == "" {
+		return false
+	}
+	rule := MatchRule(cfg.Rules, ctr.Image)
+	return rule == nil || rule.Sets(JavaToolOptions)
+}
+
+// envVars returns the variables pointed at the CA in every container.
+// Node only ever adds NODE_EXTRA_CA_CERTS to its built-in CAs.
+func (cfg Config) envVars() []envVar {
+	node := envVar{"NODE_EXTRA_CA_CERTS", cfg.caFile()}
+	switch {
+	case cfg.Merge != nil:
+		return []envVar{node}
+	case cfg.Dir:
+		return []envVar{{"SSL_CERT_DIR", cfg.mountPath()}, node}
+	}
+	return []envVar{{"SSL_CERT_FILE", cfg.caFile()}, node}
+}
+
+// caFile is the file holding every injected certificate.
+func (cfg Config) caFile() string {
+	switch {
+	case cfg.Dir:
+		return cfg.file(DirBundleFile)
+	case cfg.KubeRootBundle != "":
+		return cfg.file(KubeRootBundleFile)
+	}
+	return cfg.file("ca.crt")
+}
+
+// file returns the path of the named file in the volume.
+func (cfg Config) file(name string) string {
+	if cfg.Windows {
+		return strings.TrimRight(cfg.mountPath(), `\`) + `\` + name
+	}
+	return cfg.mountPath() + "/" + name
+}
+
+func (cfg Config) mountPath() string {
+	return first(cfg.MountPath, MountPath)
+}
+
+// BuildPatch returns the operations needed to inject the CA into the pod, and
+// warnings to return to the client. For a pod that is already injected, or
+// which nothing can be injected into, the patch is nil rather than empty or
+// holding only operations that change nothing.
+func BuildPatch(pod corev1.Pod, cfg Config) ([]PatchOp, []string, error) {
+	if cfg.SecretName == "" && cfg.ConfigMapName == "" {
+		return nil, nil, fmt.Errorf("no secret or config map to inject")
+	}
+
+	var (
+		patch    []PatchOp
+		warnings []string
+	)
+
+	if cfg.Env {
+		for _, t := range targets(pod, 0) {
+			ops, warns := pemEnvPatch(t.path, t.ctr, cfg)
+			patch = append(patch, ops...)
+			warnings = append(warnings, warns...)
+		}
+		return markerPatch(pod, cfg, patch), warnings, nil
+	}
+
+	volName := VolumeName(pod, cfg)
+	if !HasVolume(pod, cfg) {
+		if pod.Spec.Volumes == nil {
+			patch = append(patch, PatchOp{
+				Op:    "add",
+				Path:  "/spec/volumes",
+				Value: []interface{}{}, // add array if none
+			})
+		}
+
+		// TODO add documentation that the secret needs to have `ca.crt` key/value
+		patch = append(patch, PatchOp{
+			Op:    "add",
+			Path:  "/spec/volumes/-",
+			Value: volume(volName, cfg),
+		})
+	}
+
+	mergeVolName := volName + "-merged"
+	shift := 0
+	if cfg.Merge != nil {
+		if !HasMergeContainer(pod) {
+			shift = 1
+		}
+		patch = append(patch, mergePatch(pod, cfg, volName, mergeVolName)...)
+	}
+
+	for _, t := range targets(pod, shift) {
+		ops, warns := containerPatch(t.path, t.ctr, volName, mergeVolName, cfg)
+		patch = append(patch, ops...)
+		warnings = append(warnings, warns...)
+	}
+
+	return markerPatch(pod, cfg, patch), warnings, nil
+}
+
+// PatchedContainers returns the names of the containers the patch changes:
+// the pod's containers, its sidecars and then its ephemeral containers.
+func PatchedContainers(pod corev1.Pod, patch []PatchOp) []string {
+	shift := 0
+	for _, op := range patch {
+		if op.Op == "add" && op.Path == "/spec/initContainers/0" {
+			// The merge init container goes first.
+			shift = 1
+		}
+	}
+	ts := targets(pod, shift)
+	for i, ec := range pod.Spec.EphemeralContainers {
+		ts = append(ts, target{fmt.Sprintf("/spec/ephemeralContainers/%d", i), corev1.Container(ec.EphemeralContainerCommon)})
+	}
+	var names []string
+	for _, t := range ts {
+		for _, op := range patch {
+			if strings.HasPrefix(op.Path, t.path+"/") {
+				names = append(names, t.ctr.Name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// Missing describes what BuildPatch would add to the pod, for reports: the
+// volume, the merge init container, and the variables and mounts of each
+// container. It is empty for a pod that is injected.
+func Missing(pod corev1.Pod, cfg Config) []string {
+	if cfg.SecretName == "" && cfg.ConfigMapName == "" {
+		return nil
+	}
+	var out []string
+	volName := VolumeName(pod, cfg)
+	if !cfg.Env && !HasVolume(pod, cfg) {
+		out = append(out, "volume "+volName)
+	}
+	if !cfg.Env && cfg.Merge != nil && !HasMergeContainer(pod) {
+		out = append(out, "init container "+MergeContainerName)
+	}
+	for _, t := range targets(pod, 0) {
+		var ops []PatchOp
+		if cfg.Env {
+			ops, _ = pemEnvPatch(t.path, t.ctr, cfg)
+		} else {
+			ops, _ = containerPatch(t.path, t.ctr, volName, volName+"-merged", cfg)
+		}
+		for _, op := range ops {
+			v, ok := op.Value.(m)
+			switch {
+			case !ok:
+			case v["mountPath"] != nil:
+				out = append(out, fmt.Sprintf("container %q: mount at %v", t.ctr.Name, v["mountPath"]))
+			case v["name"] != nil:
+				out = append(out, fmt.Sprintf("container %q: %v", t.ctr.Name, v["name"]))
+			}
+		}
+	}
+	return out
+}
+
+// serviceAccountVolumePrefix starts the names of the token volumes the API
+// server adds to pods, which end in a suffix of their own for every pod.
+const serviceAccountVolumePrefix = "kube-api-access-"
+
+// PatchKey returns a hash of everything BuildPatch reads from the pod and
+// cfg, so that pods with the same key get the same patch and warnings, e.g.
+// the replicas of a Deployment. Names, labels and the fields of volumes and
+// containers BuildPatch never looks at are left out, as are the suffixes of
+// service account token volumes. It must grow along with BuildPatch.
+func PatchKey(pod corev1.Pod, cfg Config) string {
+	type rule struct {
+		Name, Image string
+		Env         []string
+	}
+	type mount struct{ Name, MountPath string }
+	type container struct {
+		Name, Image  string
+		Sidecar      bool
+		Env          []corev1.EnvVar
+		VolumeMounts []mount
+	}
+	type volume struct {
+		Name      string
+		Secret    *corev1.SecretVolumeSource
+		ConfigMap *corev1.ConfigMapVolumeSource
+		Projected *corev1.ProjectedVolumeSource
+	}
+	key := struct {
+		Config
+		// Regexps marshal as {}.
+		Rules          []rule
+		Annotations    map[string]string
+		Volumes        []volume
+		Containers     []container
+		InitContainers []container
+	}{Config: cfg, Annotations: pod.Annotations}
+	for _, r := range cfg.Rules {
+		img := ""
+		if r.Image != nil {
+			img = r.Image.String()
+		}
+		key.Rules = append(key.Rules, rule{r.Name, img, r.Env})
+	}
+
+	// Token volumes are renamed unless the injected volume could be taken for
+	// one, and mounts of them unless they are where the CA goes.
+	tokens := map[string]bool{}
+	if pod.Spec.Volumes != nil {
+		key.Volumes = []volume{}
+	}
+	for _, v := range pod.Spec.Volumes {
+		kv := volume{Name: v.Name, Secret: v.Secret, ConfigMap: v.ConfigMap, Projected: v.Projected}
+		if serviceAccountVolume(v) && !strings.HasPrefix(first(cfg.VolumeName, DefaultVolumeName), serviceAccountVolumePrefix) {
+			tokens[v.Name] = true
+			kv.Name = serviceAccountVolumePrefix
+		}
+		key.Volumes = append(key.Volumes, kv)
+	}
+	containers := func(ctrs []corev1.Container) []container {
+		if ctrs == nil {
+			return nil
+		}
+		out := []container{}
+		for _, ctr := range ctrs {
+			kc := container{Name: ctr.Name, Image: ctr.Image, Sidecar: Sidecar(ctr), Env: ctr.Env}
+			for _, vm := range ctr.VolumeMounts {
+				km := mount{vm.Name, vm.MountPath}
+				if tokens[vm.Name] && vm.MountPath != cfg.mountPath() && (cfg.Merge == nil || vm.MountPath != cfg.Merge.TargetPath) {
+					km.Name = serviceAccountVolumePrefix
+				}
+				kc.VolumeMounts = append(kc.VolumeMounts, km)
+			}
+			out = append(out, kc)
+		}
+		return out
+	}
+	key.Containers = containers(pod.Spec.Containers)
+	key.InitContainers = containers(pod.Spec.InitContainers)
+
+	bs, _ := json.Marshal(key)
+	sum := sha256.Sum256(bs)
+	return hex.EncodeToString(sum[:])
+}
+
+// serviceAccountVolume reports whether the volume is a service account token
+// volume added by the API server.
+func serviceAccountVolume(v corev1.Volume) bool {
+	if !strings.HasPrefix(v.Name, serviceAccountVolumePrefix) || v.Projected == nil {
+		return false
+	}
+	for _, src := range v.Projected.Sources {
+		if src.ServiceAccountToken != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// target is a container the CA is injected into, with its JSON pointer.
+type target struct {
+	path string
+	ctr  corev1.Container
+}
+
+// targets returns the pod's containers followed by its native sidecars. shift
+// is the number of init containers the patch inserts before the existing
+// ones.
+func targets(pod corev1.Pod, shift int) []target {
+	var ts []target
+	for i, ctr := range pod.Spec.Containers {
+		ts = append(ts, target{fmt.Sprintf("/spec/containers/%d", i), ctr})
+	}
+	for i, ctr := range pod.Spec.InitContainers {
+		if Sidecar(ctr) {
+			ts = append(ts, target{fmt.Sprintf("/spec/initContainers/%d", i+shift), ctr})
+		}
+	}
+	return ts
+}
+
+// Sidecar reports whether the init container is a native sidecar, which keeps
+// running alongside the pod's containers and so gets the CA like them. Other
+// init containers are left alone.
+func Sidecar(ctr corev1.Container) bool {
+	return ctr.RestartPolicy != nil && *ctr.RestartPolicy == corev1.ContainerRestartPolicyAlways
+}
+
+// Containers returns the containers the CA is injected into: the pod's
+// containers and its native sidecars.
+func Containers(pod corev1.Pod) []corev1.Container {
+	var ctrs []corev1.Container
+	for _, t := range targets(pod, 0) {
+		ctrs = append(ctrs, t.ctr)
+	}
+	return ctrs
+}
+
+// markerPatch appends to a patch changing anything the annotations recording
+// what was injected.
+func markerPatch(pod corev1.Pod, cfg Config, patch []PatchOp) []PatchOp {
+	if noop(patch) {
+		return nil
+	}
+	if pod.Annotations == nil {
+		patch = append(patch, PatchOp{
+			Op:    "add",
+			Path:  "/metadata/annotations",
+			Value: m{},
+		})
+	}
+	markers := [][2]string{
+		{InjectedAnnotation, "true"},
+		{InjectedSecretAnnotation, first(cfg.SecretName, cfg.ConfigMapName)},
+	}
+	if cfg.CAHash != "" {
+		markers = append(markers, [2]string{InjectedHashAnnotation, cfg.CAHash})
+	}
+	if cfg.Source != "" {
+		markers = append(markers, [2]string{InjectedSourceAnnotation, cfg.Source})
+	}
+	for _, kv := range markers {
+		k, v := kv[0], kv[1]
+		if cur, ok := pod.Annotations[k]; ok && cur == v {
+			continue
+		}
+		// add replaces existing members of objects.
+		patch = append(patch, PatchOp{
+			Op:    "add",
+			Path:  "/metadata/annotations/" + escapePointer(k),
+			Value: v,
+		})
+	}
+	return patch
+}
+
+// noop reports whether the patch changes nothing, i.e. it only adds the empty
+// arrays or objects later operations would fill.
+func noop(patch []PatchOp) bool {
+	for _, op := range patch {
+		switch v := op.Value.(type) {
+		case []interface{}:
+			if op.Op == "add" && len(v) == 0 {
+				continue
+			}
+		case m:
+			if op.Op == "add" && len(v) == 0 {
+				continue
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// TemplatePatch moves a patch built for a pod to the pod template at the JSON
+// pointer root, e.g. /spec/template, and marks the template as injected. The
+// patch must not be empty, so it creates the annotations if needed.
+func TemplatePatch(patch []PatchOp, root string) []PatchOp {
+	out := make([]PatchOp, 0, len(patch)+1)
+	for _, op := range patch {
+		op.Path = root + op.Path
+		out = append(out, op)
+	}
+	return append(out, PatchOp{
+		Op:    "add",
+		Path:  root + "/metadata/annotations/" + escapePointer(InjectedTemplateAnnotation),
+		Value: "true",
+	})
+}
+
+// FromTemplate reports whether the pod was made from a template the CA was
+// injected into.
+func FromTemplate(pod corev1.Pod) bool {
+	return pod.Annotations[InjectedTemplateAnnotation] == "true"
+}
+
+// escapePointer escapes a JSON pointer reference token.
+func escapePointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
+
+// pemEnvPatch sets PEMEnv in the container at path from the configured key.
+func pemEnvPatch(path string, ctr corev1.Container, cfg Config) ([]PatchOp, []string) {
+	valueFrom := m{"secretKeyRef": keyRef(cfg.SecretName, cfg)}
+	if cfg.ConfigMapName != "" {
+		valueFrom = m{"configMapKeyRef": keyRef(cfg.ConfigMapName, cfg)}
+	}
+
+	j := envIndex(ctr, PEMEnv)
+	switch {
+	case j >= 0 && hasPEMEnv(ctr, cfg):
+		return nil, nil
+	case j >= 0 && !cfg.OverrideEnv:
+		return nil, []string{fmt.Sprintf("container %q already sets %s; leaving it alone", ctr.Name, PEMEnv)}
+	case j >= 0:
+		return []PatchOp{{
+			Op:    "replace",
+			Path:  fmt.Sprintf("%s/env/%d", path, j),
+			Value: m{"name": PEMEnv, "valueFrom": valueFrom},
+		}}, nil
+	}
+	var warnings []string
+	warning, keep := cfg.envFromConflict(ctr, PEMEnv)
+	if warning != "" {
+		warnings = append(warnings, warning)
+	}
+	if keep {
+		return nil, warnings
+	}
+
+	var patch []PatchOp
+	if ctr.Env == nil {
+		patch = append(patch, PatchOp{
+			Op:    "add",
+			Path:  path + "/env",
+			Value: []interface{}{}, //add the array if none
+		})
+	}
+	return append(patch, PatchOp{
+		Op:    "add",
+		Path:  path + "/env/-",
+		Value: m{"name": PEMEnv, "valueFrom": valueFrom},
+	}), warnings
+}
+
+// envFromConflict returns a warning if the container gets the variable from
+// envFrom, and whether to leave it alone rather than override it.
+func (cfg Config) envFromConflict(ctr corev1.Container, name string) (string, bool) {
+	src, ok := cfg.EnvFrom[ctr.Name][name]
+	switch {
+	case !ok:
+		return "", false
+	case cfg.KeepEnvFrom:
+		return fmt.Sprintf("container %q gets %s from %s; leaving it alone", ctr.Name, name, src), true
+	}
+	return fmt.Sprintf("container %q gets %s from %s, which the injected value overrides", ctr.Name, name, src), false
+}
+
+func keyRef(name string, cfg Config) m {
+	ref := m{
+		"name": name,
+		"key":  first(cfg.Key, "ca.crt"),
+	}
+	if cfg.Optional {
+		ref["optional"] = true
+	}
+	return ref
+}
+
+// hasPEMEnv reports whether the container sets PEMEnv from the configured
+// secret or config map.
+func hasPEMEnv(ctr corev1.Container, cfg Config) bool {
+	j := envIndex(ctr, PEMEnv)
+	if j < 0 || ctr.Env[j].ValueFrom == nil {
+		return false
+	}
+	key := first(cfg.Key, "ca.crt")
+	vf := ctr.Env[j].ValueFrom
+	if cfg.ConfigMapName != "" {
+		return vf.ConfigMapKeyRef != nil && vf.ConfigMapKeyRef.Name == cfg.ConfigMapName && vf.ConfigMapKeyRef.Key == key
+	}
+	return vf.SecretKeyRef != nil && vf.SecretKeyRef.Name == cfg.SecretName && vf.SecretKeyRef.Key == key
+}
+
+// containerPatch points the container at path at the CA, mounting it from
+// volName.
+func containerPatch(path string, ctr corev1.Container, volName, mergeVolName string, cfg Config) ([]PatchOp, []string) {
+	var (
+		patch    []PatchOp
+		warnings []string
+	)
+	if vm := mountAt(ctr, cfg.mountPath()); vm != nil && vm.Name != volName {
+		// Mounting on top would make the pod invalid, and the env vars
+		// would point at someone else's files.
+		return nil, []string{fmt.Sprintf("container %q already mounts volume %q at %s; not injecting the CA into it", ctr.Name, vm.Name, cfg.mountPath())}
+	}
+
+	var envs []PatchOp
+	for _, ev := range cfg.envVarsFor(ctr) {
+		j := envIndex(ctr, ev.name)
+		if j < 0 {
+			warning, keep := cfg.envFromConflict(ctr, ev.name)
+			if warning != "" {
+				warnings = append(warnings, warning)
+			}
+			if keep {
+				continue
+			}
+		}
+		if j >= 0 {
+			env := ctr.Env[j]
+			if env.ValueFrom == nil && env.Value == ev.value {
+				continue
+			}
+			if !cfg.OverrideEnv {
+				warnings = append(warnings, fmt.Sprintf("container %q already sets %s; leaving it alone", ctr.Name, ev.name))
+				continue
+			}
+			envs = append(envs, PatchOp{
+				Op:   "replace",
+				Path: fmt.Sprintf("%s/env/%d", path, j),
+				Value: m{
+					"name":  ev.name,
+					"value": ev.value,
+				},
+			})
+			continue
+		}
+		envs = append(envs, PatchOp{
+			Op:   "add",
+			Path: path + "/env/-",
+			Value: m{
+				"name":  ev.name,
+				"value": ev.value,
+			},
+		})
+	}
+
+	if cfg.javaFor(ctr) {
+		ops, warning := javaToolOptionsPatch(path, ctr, cfg.JavaToolOptions)
+		if warning != "" {
+			warnings = append(warnings, warning)
+		}
+		envs = append(envs, ops...)
+	}
+
+	if len(envs) > 0 && ctr.Env == nil {
+		patch = append(patch, PatchOp{
+			Op:    "add",
+			Path:  path + "/env",
+			Value: []interface{}{}, //add the array if none
+		})
+	}
+	patch = append(patch, envs...)
+
+	var mounts []interface{}
+	if !HasMount(ctr, volName, cfg.mountPath()) {
+		mounts = append(mounts, m{
+			"name":      volName,
+			"mountPath": cfg.mountPath(),
+			"readOnly":  true,
+		})
+	}
+	if cfg.Merge != nil {
+		switch vm := mountAt(ctr, cfg.Merge.TargetPath); {
+		case vm == nil:
+			mounts = append(mounts, m{
+				"name":      mergeVolName,
+				"mountPath": cfg.Merge.TargetPath,
+				"subPath":   mergeFile,
+				"readOnly":  true,
+			})
+		case vm.Name != mergeVolName:
+			warnings = append(warnings, fmt.Sprintf("container %q already mounts volume %q at %s; not mounting the merged bundle", ctr.Name, vm.Name, cfg.Merge.TargetPath))
+		}
+	}
+	if len(mounts) > 0 && len(ctr.VolumeMounts) == 0 {
+		patch = append(patch, PatchOp{
+			Op:    "add",
+			Path:  path + "/volumeMounts",
+			Value: []interface{}{}, //add the array if none
+		})
+	}
+	for _, mount := range mounts {
+		patch = append(patch, PatchOp{
+			Op:    "add",
+			Path:  path + "/volumeMounts/-",
+			Value: mount,
+		})
+	}
+	return patch, warnings
+}
+
+// AddsEphemeralContainers reports whether pod has ephemeral containers which
+// are not in old, the only ones BuildUpdatePatch patches.
+func AddsEphemeralContainers(old, pod corev1.Pod) bool {
+	existing := map[string]bool{}
+	for _, ec := range old.Spec.EphemeralContainers {
+		existing[ec.Name] = true
+	}
+	for _, ec := range pod.Spec.EphemeralContainers {
+		if !existing[ec.Name] {
+			return true
+		}
+	}
+	return false
+}
+
+// BuildUpdatePatch returns the operations needed to inject the CA into what
+// an update adds to the pod. The volume and regular containers of a running
+// pod cannot change, so only ephemeral containers which are not in old yet are
+// patched, and only if the pod already carries the CA volume. Like BuildPatch,
+// it returns a nil patch if nothing changes.
+func BuildUpdatePatch(old, pod corev1.Pod, cfg Config) ([]PatchOp, []string, error) {
+	if cfg.SecretName == "" && cfg.ConfigMapName == "" {
+		return nil, nil, fmt.Errorf("no secret or config map to inject")
+	}
+	if !Injected(pod, cfg) {
+		return nil, nil, nil
+	}
+
+	existing := map[string]bool{}
+	for _, ec := range old.Spec.EphemeralContainers {
+		existing[ec.Name] = true
+	}
+
+	var (
+		patch    []PatchOp
+		warnings []string
+	)
+	volName := VolumeName(pod, cfg)
+	for i, ec := range pod.Spec.EphemeralContainers {
+		if existing[ec.Name] {
+			continue
+		}
+		path, ctr := fmt.Sprintf("/spec/ephemeralContainers/%d", i), corev1.Container(ec.EphemeralContainerCommon)
+		var (
+			ops   []PatchOp
+			warns []string
+		)
+		if cfg.Env {
+			ops, warns = pemEnvPatch(path, ctr, cfg)
+		} else {
+			ops, warns = containerPatch(path, ctr, volName, volName+"-merged", cfg)
+		}
+		patch = append(patch, ops...)
+		warnings = append(warnings, warns...)
+	}
+	if noop(patch) {
+		return nil, warnings, nil
+	}
+	return patch, warnings, nil
+}
+
+// mergePatch adds the emptyDir holding the merged bundle and the init
+// container writing it, running before any other init container.
+func mergePatch(pod corev1.Pod, cfg Config, volName, mergeVolName string) []PatchOp {
+	var patch []PatchOp
+	if findVolume(pod, mergeVolName) == nil {
+		// The CA volume was added before, so the array exists.
+		patch = append(patch, PatchOp{
+			Op:   "add",
+			Path: "/spec/volumes/-",
+			Value: m{
+				"name":     mergeVolName,
+				"emptyDir": m{},
+			},
+		})
+	}
+
+	if HasMergeContainer(pod) {
+		return patch
+	}
+	if pod.Spec.InitContainers == nil {
+		patch = append(patch, PatchOp{
+			Op:    "add",
+			Path:  "/spec/initContainers",
+			Value: []interface{}{}, // add array if none
+		})
+	}
+	return append(patch, PatchOp{
+		Op:   "add",
+		Path: "/spec/initContainers/0",
+		Value: m{
+			"name":  MergeContainerName,
+			"image": cfg.Merge.Image,
+			"command": []string{
+				"sh", "-c", `cat "$0" "$1" > "$2"`,
+				cfg.Merge.SourcePath, cfg.caFile(), mergeDir + "/" + mergeFile,
+			},
+			"volumeMounts": []interface{}{
+				m{"name": volName, "mountPath": cfg.mountPath(), "readOnly": true},
+				m{"name": mergeVolName, "mountPath": mergeDir},
+			},
+		},
+	})
+}
+
+// HasMergeContainer reports whether the pod already has the merge init
+// container.
+func HasMergeContainer(pod corev1.Pod) bool {
+	for _, ctr := range pod.Spec.InitContainers {
+		if ctr.Name == MergeContainerName {
+			return true
+		}
+	}
+	return false
+}
+
+// Injected reports whether the pod carries everything BuildPatch would add at
+// the pod level: the CA volume and, in merge mode, the init container. In env
+// mode, which adds nothing to the pod, every container must set PEMEnv from
+// the configured source instead, unless it sets PEMEnv itself.
+func Injected(pod corev1.Pod, cfg Config) bool {
+	if cfg.Env {
+		for _, ctr := range Containers(pod) {
+			if envIndex(ctr, PEMEnv) < 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return HasVolume(pod, cfg) && (cfg.Merge == nil || HasMergeContainer(pod))
+}
+
+// volume returns the injected volume, mapping Key to ca.crt if needed.
+func volume(name string, cfg Config) m {
+	var items []interface{}
+	if cfg.Key != "" && cfg.Key != "ca.crt" && !cfg.Dir {
+		items = []interface{}{m{"key": cfg.Key, "path": "ca.crt"}}
+	}
+
+	src := m{}
+	if items != nil {
+		src["items"] = items
+	}
+	if cfg.Optional {
+		src["optional"] = true
+	}
+	if cfg.DefaultMode != nil {
+		src["defaultMode"] = *cfg.DefaultMode
+	}
+
+	if cfg.ConfigMapName != "" {
+		src["name"] = cfg.ConfigMapName
+		return m{
+			"name":      name,
+			"configMap": src,
+		}
+	}
+	if cfg.KubeRootBundle != "" {
+		return m{
+			"name":      name,
+			"projected": projected(cfg),
+		}
+	}
+	src["secretName"] = cfg.SecretName
+	return m{
+		"name":   name,
+		"secret": src,
+	}
+}
+
+// projected returns the source of the projected volume combining the secret,
+// the cluster's CA and their bundle, always in that order.
+func projected(cfg Config) m {
+	secret := func(name, key, path string) m {
+		src := m{
+			"name":  name,
+			"items": []interface{}{m{"key": key, "path": path}},
+		}
+		if cfg.Optional {
+			src["optional"] = true
+		}
+		return m{"secret": src}
+	}
+	out := m{"sources": []interface{}{
+		secret(cfg.SecretName, first(cfg.Key, "ca.crt"), "ca.crt"),
+		m{"configMap": m{
+			"name":  KubeRootConfigMap,
+			"items": []interface{}{m{"key": "ca.crt", "path": KubeRootFile}},
+		}},
+		secret(cfg.KubeRootBundle, KubeRootBundleFile, KubeRootBundleFile),
+	}}
+	if cfg.DefaultMode != nil {
+		out["defaultMode"] = *cfg.DefaultMode
+	}
+	return out
+}
+
+// VolumeName returns the name of the injected volume for the pod. If the pod
+// already has an unrelated volume of the configured name, e.g. from a copied
+// chart, a name suffixed with a hash of the secret name is used instead so the
+// patched pod does not have duplicate volumes.
+func VolumeName(pod corev1.Pod, cfg Config) string {
+	name := first(cfg.VolumeName, DefaultVolumeName)
+	vol := findVolume(pod, name)
+	if vol == nil || isSource(*vol, cfg) {
+		return name
+	}
+	sum := sha256.Sum256([]byte(first(cfg.ConfigMapName, cfg.SecretName)))
+	return name + "-" + hex.EncodeToString(sum[:])[:8]
+}
+
+// HasVolume reports whether the pod already carries the injected volume
+// pointing at the configured secret or config map. Whether the volume is
+// optional does not matter.
+func HasVolume(pod corev1.Pod, cfg Config) bool {
+	vol := findVolume(pod, VolumeName(pod, cfg))
+	return vol != nil && isSource(*vol, cfg)
+}
+
+// HasMount reports whether the container already mounts the named volume at
+// path.
+func HasMount(ctr corev1.Container, volume, path string) bool {
+	for _, vm := range ctr.VolumeMounts {
+		if vm.Name == volume && vm.MountPath == path {
+			return true
+		}
+	}
+	return false
+}
+
+func mountAt(ctr corev1.Container, path string) *corev1.VolumeMount {
+	for i, vm := range ctr.VolumeMounts {
+		if vm.MountPath == path {
+			return &ctr.VolumeMounts[i]
+		}
+	}
+	return nil
+}
+
+func findVolume(pod corev1.Pod, name string) *corev1.Volume {
+	for i, vol := range pod.Spec.Volumes {
+		if vol.Name == name {
+			return &pod.Spec.Volumes[i]
+		}
+	}
+	return nil
+}
+
+func isSource(vol corev1.Volume, cfg Config) bool {
+	switch {
+	case cfg.ConfigMapName != "":
+		return vol.ConfigMap != nil && vol.ConfigMap.Name == cfg.ConfigMapName && hasItems(vol.ConfigMap.Items, cfg)
+	case cfg.KubeRootBundle != "":
+		return vol.Projected != nil && isProjected(*vol.Projected, cfg)
+	}
+	return vol.Secret != nil && vol.Secret.SecretName == cfg.SecretName && hasItems(vol.Secret.Items, cfg)
+}
+
+// hasItems reports whether the items of a volume map Key to ca.crt, as volume
+// does, if that is needed at all.
+func hasItems(items []corev1.KeyToPath, cfg Config) bool {
+	if cfg.Key == "" || cfg.Key == "ca.crt" || cfg.Dir {
+		return true
+	}
+	for _, it := range items {
+		if it.Key == cfg.Key && it.Path == "ca.crt" {
+			return true
+		}
+	}
+	return false
+}
+
+// isProjected reports whether the projected volume combines the sources
+// projected returns, in any order.
+func isProjected(vol corev1.ProjectedVolumeSource, cfg Config) bool {
+	var secret, root, bundle bool
+	for _, src := range vol.Sources {
+		switch {
+		case src.Secret != nil && src.Secret.Name == cfg.SecretName:
+			secret = true
+		case src.Secret != nil && src.Secret.Name == cfg.KubeRootBundle:
+			bundle = true
+		case src.ConfigMap != nil && src.ConfigMap.Name == KubeRootConfigMap:
+			root = true
+		}
+	}
+	return secret && root && bundle
+}
+
+func first(ss ...string) string {
+	for _, s := range ss {
+		if s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// envIndex returns the index of the named variable in the container's env, or
+// -1 if it is not set.
+func envIndex(ctr corev1.Container, name string) int {
+	for j, env := range ctr.Env {
+		if env.Name == name {
+			return j
+		}
+	}
+	return -1
+}
+
+// javaToolOptionsPatch appends opts to any JAVA_TOOL_OPTIONS the container
+// already sets.
+func javaToolOptionsPatch(path string, ctr corev1.Container, opts string) ([]PatchOp, string) {
+	j := envIndex(ctr, JavaToolOptions)
+	if j < 0 {
+		return []PatchOp{{
+			Op:   "add",
+			Path: path + "/env/-",
+			Value: m{
+				"name":  JavaToolOptions,
+				"value": opts,
+			},
+		}}, ""
+	}
+
+	env := ctr.Env[j]
+	if env.ValueFrom != nil {
+		return nil, fmt.Sprintf("container %q sets JAVA_TOOL_OPTIONS from a reference; not injecting truststore options", ctr.Name)
+	}
+	if strings.Contains(env.Value, opts) {
+		return nil, ""
+	}
+	return []PatchOp{{
+		Op:    "replace",
+		Path:  fmt.Sprintf("%s/env/%d/value", path, j),
+		Value: strings.TrimSpace(env.Value + " " + opts),
+	}}, ""
+}
@@ -0,0 +1,254 @@
+package mutate
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testPod(containers ...corev1.Container) corev1.Pod {
+	return corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "team"},
+		Spec:       corev1.PodSpec{Containers: containers},
+	}
+}
+
+// apply returns the pod with the patch applied.
+func apply(t *testing.T, pod corev1.Pod, patch []PatchOp) corev1.Pod {
+	t.Helper()
+	ops, err := json.Marshal(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := jsonpatch.DecodePatch(ops)
+	if err != nil {
+		t.Fatalf("decoding patch %s: %v", ops, err)
+	}
+	bs, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs, err = p.Apply(bs); err != nil {
+		t.Fatalf("applying patch %s: %v", ops, err)
+	}
+	var out corev1.Pod
+	if err := json.Unmarshal(bs, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestBuildPatch(t *testing.T) {
+	app := corev1.Container{Name: "app", Image: "nginx"}
+	withEnv := corev1.Container{Name: "app", Image: "nginx", Env: []corev1.EnvVar{{Name: "PORT", Value: "8080"}}}
+	withMount := corev1.Container{Name: "app", Image: "nginx", VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}}}
+	atTarget := corev1.Container{Name: "proxy", Image: "envoy", VolumeMounts: []corev1.VolumeMount{{Name: "certs", MountPath: MountPath}}}
+	data := corev1.Volume{Name: "data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}
+	certs := corev1.Volume{Name: "certs", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}
+	sameName := corev1.Volume{Name: DefaultVolumeName, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}
+
+	withVolumes := func(pod corev1.Pod, vols ...corev1.Volume) corev1.Pod {
+		pod.Spec.Volumes = vols
+		return pod
+	}
+
+	tests := []struct {
+		name string
+		pod  corev1.Pod
+		cfg  Config
+		err  bool
+		// volume is the name of the injected volume.
+		volume string
+		// injected and skipped name the containers which get the CA and
+		// which are left alone.
+		injected, skipped []string
+		warning           string
+	}{
+		{name: "no secret", pod: testPod(app), err: true},
+		{name: "nil volumes", pod: testPod(app), volume: DefaultVolumeName, injected: []string{"app"}},
+		{name: "existing volumes", pod: withVolumes(testPod(app), data), volume: DefaultVolumeName, injected: []string{"app"}},
+		{name: "nil env", pod: testPod(withMount), volume: DefaultVolumeName, injected: []string{"app"}},
+		{name: "existing env", pod: testPod(withEnv), volume: DefaultVolumeName, injected: []string{"app"}},
+		{name: "existing mounts", pod: withVolumes(testPod(withMount), data), volume: DefaultVolumeName, injected: []string{"app"}},
+		{
+			name:     "multiple containers",
+			pod:      testPod(app, corev1.Container{Name: "worker", Image: "busybox"}, corev1.Container{Name: "metrics", Image: "exporter", Env: withEnv.Env}),
+			volume:   DefaultVolumeName,
+			injected: []string{"app", "worker", "metrics"},
+		},
+		{
+			name:     "mount at the target path",
+			pod:      withVolumes(testPod(app, atTarget), certs),
+			volume:   DefaultVolumeName,
+			injected: []string{"app"},
+			skipped:  []string{"proxy"},
+			warning:  `container "proxy" already mounts volume "certs" at /ssl`,
+		},
+		{
+			name:     "volume of the same name",
+			pod:      withVolumes(testPod(app), sameName),
+			volume:   DefaultVolumeName + "-9d19a218",
+			injected: []string{"app"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			if !tt.err {
+				cfg.SecretName = "corp-ca"
+			}
+			patch, warnings, err := BuildPatch(tt.pod, cfg)
+			if tt.err {
+				if err == nil {
+					t.Errorf("want an error, got patch %+v", patch)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := apply(t, tt.pod, patch)
+
+			if tt.warning == "" && len(warnings) > 0 {
+				t.Errorf("unexpected warnings %q", warnings)
+			}
+			if tt.warning != "" && (len(warnings) != 1 || !strings.Contains(warnings[0], tt.warning)) {
+				t.Errorf("warnings %q, want one containing %q", warnings, tt.warning)
+			}
+
+			if n := len(got.Spec.Volumes); n != len(tt.pod.Spec.Volumes)+1 {
+				t.Fatalf("%d volumes, want %d", n, len(tt.pod.Spec.Volumes)+1)
+			}
+			if n := len(tt.pod.Spec.Volumes); n > 0 && !reflect.DeepEqual(got.Spec.Volumes[:n], tt.pod.Spec.Volumes) {
+				t.Errorf("existing volumes changed: %+v", got.Spec.Volumes)
+			}
+			vol := got.Spec.Volumes[len(got.Spec.Volumes)-1]
+			if vol.Name != tt.volume || vol.Secret == nil || vol.Secret.SecretName != "corp-ca" {
+				t.Errorf("injected volume %+v, want %s of secret corp-ca", vol, tt.volume)
+			}
+
+			for i, ctr := range got.Spec.Containers {
+				orig := tt.pod.Spec.Containers[i]
+				if contains(tt.skipped, ctr.Name) {
+					if !reflect.DeepEqual(ctr, orig) {
+						t.Errorf("container %q changed: %+v", ctr.Name, ctr)
+					}
+					continue
+				}
+				if !contains(tt.injected, ctr.Name) {
+					t.Fatalf("container %q neither injected nor skipped", ctr.Name)
+				}
+				wantMounts := append(append([]corev1.VolumeMount(nil), orig.VolumeMounts...), corev1.VolumeMount{Name: tt.volume, MountPath: MountPath, ReadOnly: true})
+				if !reflect.DeepEqual(ctr.VolumeMounts, wantMounts) {
+					t.Errorf("container %q mounts %+v, want %+v", ctr.Name, ctr.VolumeMounts, wantMounts)
+				}
+				wantEnv := append(append([]corev1.EnvVar(nil), orig.Env...),
+					corev1.EnvVar{Name: "SSL_CERT_FILE", Value: CAFile},
+					corev1.EnvVar{Name: "NODE_EXTRA_CA_CERTS", Value: CAFile})
+				if !reflect.DeepEqual(ctr.Env, wantEnv) {
+					t.Errorf("container %q env %+v, want %+v", ctr.Name, ctr.Env, wantEnv)
+				}
+			}
+
+			if got.Annotations[InjectedAnnotation] != "true" || got.Annotations[InjectedSecretAnnotation] != "corp-ca" {
+				t.Errorf("annotations %v", got.Annotations)
+			}
+			if again, _, err := BuildPatch(got, cfg); err != nil || again != nil {
+				t.Errorf("patching the injected pod again: %+v, %v", again, err)
+			}
+		})
+	}
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPatchKey(t *testing.T) {
+	cfg := Config{SecretName: "corp-ca"}
+	base := func() corev1.Pod {
+		pod := testPod(corev1.Container{
+			Name:         "app",
+			Image:        "nginx",
+			Env:          []corev1.EnvVar{{Name: "PORT", Value: "8080"}},
+			VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+		})
+		pod.Annotations = map[string]string{"microcumul.us/injectssl": "corp-ca"}
+		pod.Spec.Volumes = []corev1.Volume{
+			{Name: "data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+			{Name: "kube-api-access-abcde", VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{{ServiceAccountToken: &corev1.ServiceAccountTokenProjection{Path: "token"}}},
+			}}},
+		}
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{Name: "kube-api-access-abcde", MountPath: "/var/run/secrets/kubernetes.io/serviceaccount"})
+		return pod
+	}
+	key := PatchKey(base(), cfg)
+
+	// Replicas of one template differ in these and must share a key.
+	same := map[string]func(*corev1.Pod){
+		"name":   func(p *corev1.Pod) { p.Name = "web-2" },
+		"labels": func(p *corev1.Pod) { p.Labels = map[string]string{"pod-template-hash": "abc"} },
+		"token volume": func(p *corev1.Pod) {
+			p.Spec.Volumes[1].Name = "kube-api-access-fghij"
+			p.Spec.Containers[0].VolumeMounts[1].Name = "kube-api-access-fghij"
+		},
+		"node": func(p *corev1.Pod) { p.Spec.NodeName = "node-2" },
+	}
+	for name, change := range same {
+		pod := base()
+		change(&pod)
+		if got := PatchKey(pod, cfg); got != key {
+			t.Errorf("%s: key changed", name)
+		}
+	}
+
+	// Pods differing in any of these get different patches.
+	differ := map[string]func(*corev1.Pod, *Config){
+		"env value": func(p *corev1.Pod, _ *Config) { p.Spec.Containers[0].Env[0].Value = "9090" },
+		"env added": func(p *corev1.Pod, _ *Config) {
+			p.Spec.Containers[0].Env = append(p.Spec.Containers[0].Env, corev1.EnvVar{Name: "SSL_CERT_FILE", Value: "/x"})
+		},
+		"env removed": func(p *corev1.Pod, _ *Config) { p.Spec.Containers[0].Env = nil },
+		"mount path":  func(p *corev1.Pod, _ *Config) { p.Spec.Containers[0].VolumeMounts[0].MountPath = MountPath },
+		"mount added": func(p *corev1.Pod, _ *Config) {
+			p.Spec.Containers[0].VolumeMounts = append(p.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{Name: "data", MountPath: "/more"})
+		},
+		"mounts removed":   func(p *corev1.Pod, _ *Config) { p.Spec.Containers[0].VolumeMounts = nil },
+		"annotation value": func(p *corev1.Pod, _ *Config) { p.Annotations["microcumul.us/injectssl"] = "other-ca" },
+		"annotation added": func(p *corev1.Pod, _ *Config) { p.Annotations[InjectedAnnotation] = "true" },
+		"annotations nil":  func(p *corev1.Pod, _ *Config) { p.Annotations = nil },
+		"container name":   func(p *corev1.Pod, _ *Config) { p.Spec.Containers[0].Name = "worker" },
+		"container image":  func(p *corev1.Pod, _ *Config) { p.Spec.Containers[0].Image = "busybox" },
+		"container added": func(p *corev1.Pod, _ *Config) {
+			p.Spec.Containers = append(p.Spec.Containers, corev1.Container{Name: "worker"})
+		},
+		"volume of the name": func(p *corev1.Pod, _ *Config) { p.Spec.Volumes[0].Name = DefaultVolumeName },
+		"volumes nil":        func(p *corev1.Pod, _ *Config) { p.Spec.Volumes = nil },
+		"secret":             func(_ *corev1.Pod, c *Config) { c.SecretName = "other-ca" },
+		"key":                func(_ *corev1.Pod, c *Config) { c.Key = "bundle.pem" },
+		"mount path setting": func(_ *corev1.Pod, c *Config) { c.MountPath = "/certs" },
+		"ca hash":            func(_ *corev1.Pod, c *Config) { c.CAHash = "abc" },
+	}
+	keys := map[string]string{key: "base"}
+	for name, change := range differ {
+		pod, c := base(), cfg
+		change(&pod, &c)
+		got := PatchKey(pod, c)
+		if other, ok := keys[got]; ok {
+			t.Errorf("%s: same key as %s", name, other)
+		}
+		keys[got] = name
+	}
+}
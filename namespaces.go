@@ -0,0 +1,68 @@
+package main
+
+import (
+	"path"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// namespaceFilter decides which namespaces are in scope, based on lists of
+// names or glob patterns such as `team-*`. An empty include list means every
+// namespace; exclusions always win.
+type namespaceFilter struct {
+	include []string
+	exclude []string
+}
+
+func newNamespaceFilter(include, exclude string) namespaceFilter {
+	return namespaceFilter{
+		include: splitList(include),
+		exclude: splitList(exclude),
+	}
+}
+
+// splitList splits a comma-separated setting, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// namespaceExcluded reports whether ns is one the injector must never touch:
+// its own namespace, or one in EXCLUDE_NAMESPACES.
+func namespaceExcluded(cfg *viper.Viper, own, ns string) bool {
+	return (own != "" && ns == own) || matchAny(splitList(cfg.GetString("exclude.namespaces")), ns)
+}
+
+func matchAny(patterns []string, ns string) bool {
+	for _, pat := range patterns {
+		if ok, _ := path.Match(pat, ns); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (f namespaceFilter) allowed(ns string) bool {
+	if matchAny(f.exclude, ns) {
+		return false
+	}
+	return len(f.include) == 0 || matchAny(f.include, ns)
+}
+
+// literal returns the include list if it names namespaces exactly, so that
+// callers can scope their watches to them; it returns nil if the list is
+// empty or contains any patterns.
+func (f namespaceFilter) literal() []string {
+	for _, ns := range f.include {
+		if strings.ContainsAny(ns, `*?[\`) {
+			return nil
+		}
+	}
+	return f.include
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	batchlisters "k8s.io/client-go/listers/batch/v1"
+)
+
+// ownerSyncTimeout bounds how long startup waits for the workload caches;
+// without permissions to list workloads they never sync.
+const ownerSyncTimeout = 30 * time.Second
+
+// owners resolves the workloads pods belong to when OWNER_LOOKUP is set; nil
+// otherwise. It is shared by the webhook and the reconciler so both inherit
+// the same annotation.
+var owners *ownerResolver
+
+// ownerResolver looks up the controllers of pods in informer caches, so that
+// admissions never wait on the API server for them.
+type ownerResolver struct {
+	factory      informers.SharedInformerFactory
+	replicaSets  appslisters.ReplicaSetLister
+	deployments  appslisters.DeploymentLister
+	statefulSets appslisters.StatefulSetLister
+	daemonSets   appslisters.DaemonSetLister
+	jobs         batchlisters.JobLister
+	cronJobs     batchlisters.CronJobLister
+}
+
+// newOwnerResolver registers workload informers with a factory of their own,
+// which start runs.
+func newOwnerResolver(cs kubernetes.Interface) *ownerResolver {
+	f := informers.NewSharedInformerFactory(cs, 10*time.Minute)
+	return &ownerResolver{
+		factory:      f,
+		replicaSets:  f.Apps().V1().ReplicaSets().Lister(),
+		deployments:  f.Apps().V1().Deployments().Lister(),
+		statefulSets: f.Apps().V1().StatefulSets().Lister(),
+		daemonSets:   f.Apps().V1().DaemonSets().Lister(),
+		jobs:         f.Batch().V1().Jobs().Lister(),
+		cronJobs:     f.Batch().V1().CronJobs().Lister(),
+	}
+}
+
+// start runs the informers until ctx is cancelled and waits up to
+// ownerSyncTimeout for them to sync. Workloads which are not cached yet are
+// simply not found, so pods are then handled as if they had no owner.
+func (o *ownerResolver) start(ctx context.Context) {
+	o.factory.Start(ctx.Done())
+	syncCtx, cancel := context.WithTimeout(ctx, ownerSyncTimeout)
+	defer cancel()
+	for typ, ok := range o.factory.WaitForCacheSync(syncCtx.Done()) {
+		if !ok {
+			lg.WithField("type", typ.String()).Error("could not sync workload cache; is the injector allowed to list workloads? Pods do not inherit the annotation of workloads until it syncs")
+		}
+	}
+}
+
+// inheritedSecret returns the injection annotation, or label, of the nearest
+// workload owning the pod which has one, e.g. the ReplicaSet and then the
+// Deployment of a pod, or the empty string.
+func inheritedSecret(pod corev1.Pod) string {
+	if owners == nil {
+		return ""
+	}
+	for _, obj := range owners.chain(pod) {
+		if v := first(annotation(obj.GetAnnotations(), label), annotation(obj.GetLabels(), label)); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// chain returns the pod's controller and that controller's, as far as they
+// are cached: a ReplicaSet and its Deployment, a Job and its CronJob, or a
+// StatefulSet or DaemonSet.
+func (o *ownerResolver) chain(pod corev1.Pod) []metav1.Object {
+	var out []metav1.Object
+	ref := metav1.GetControllerOf(&pod)
+	for len(out) < 2 && ref != nil {
+		obj := o.get(pod.Namespace, *ref)
+		if obj == nil {
+			break
+		}
+		out = append(out, obj)
+		ref = metav1.GetControllerOf(obj)
+	}
+	return out
+}
+
+// get returns the cached workload the reference points at, or nil if it is
+// not one of the kinds looked up, not cached, or another object of the same
+// name.
+func (o *ownerResolver) get(namespace string, ref metav1.OwnerReference) metav1.Object {
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return nil
+	}
+	var obj metav1.Object
+	switch gv.Group + "/" + ref.Kind {
+	case "apps/ReplicaSet":
+		if rs, err := o.replicaSets.ReplicaSets(namespace).Get(ref.Name); err == nil {
+			obj = rs
+		}
+	case "apps/Deployment":
+		if d, err := o.deployments.Deployments(namespace).Get(ref.Name); err == nil {
+			obj = d
+		}
+	case "apps/StatefulSet":
+		if ss, err := o.statefulSets.StatefulSets(namespace).Get(ref.Name); err == nil {
+			obj = ss
+		}
+	case "apps/DaemonSet":
+		if ds, err := o.daemonSets.DaemonSets(namespace).Get(ref.Name); err == nil {
+			obj = ds
+		}
+	case "batch/Job":
+		if j, err := o.jobs.Jobs(namespace).Get(ref.Name); err == nil {
+			obj = j
+		}
+	case "batch/CronJob":
+		if cj, err := o.cronJobs.CronJobs(namespace).Get(ref.Name); err == nil {
+			obj = cj
+		}
+	}
+	if obj == nil || obj.GetUID() != ref.UID {
+		return nil
+	}
+	return obj
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// reconcilePass tallies what the reconciler's workers did since its queues
+// were last empty. Resyncs queue every pod at once, so a pass lasts from then
+// until the queues drain and the last worker is done; informer events in
+// between make passes of their own.
+type reconcilePass struct {
+	mu           sync.Mutex
+	start        time.Time
+	busy         int
+	examined     int
+	noncompliant int
+	deleted      int
+	errors       int
+	skipped      map[string]int
+	// finished is when the last pass ended.
+	finished time.Time
+}
+
+// begin starts a pass unless one is under way, and counts a worker in.
+func (p *reconcilePass) begin() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.start.IsZero() {
+		p.start = time.Now()
+		p.skipped = map[string]int{}
+	}
+	p.busy++
+}
+
+func (p *reconcilePass) tally(fn func(p *reconcilePass)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fn(p)
+}
+
+// end counts a worker out. If it was the last one busy and the queues are
+// idle, the pass is observed and logged. Passes of a single pod with nothing
+// to do are only logged at debug level, since every pod event makes one.
+func (p *reconcilePass) end(idle bool) {
+	p.mu.Lock()
+	p.busy--
+	if p.busy > 0 || !idle || p.start.IsZero() {
+		p.mu.Unlock()
+		return
+	}
+	took := time.Since(p.start)
+	fields := logrus.Fields{
+		"examined":     p.examined,
+		"noncompliant": p.noncompliant,
+		"deleted":      p.deleted,
+		"errors":       p.errors,
+		"skipped":      p.skipped,
+		"duration":     took.String(),
+	}
+	quiet := p.examined <= 1 && p.noncompliant == 0 && p.errors == 0
+	failed := p.errors > 0
+	p.start, p.finished = time.Time{}, time.Now()
+	p.examined, p.noncompliant, p.deleted, p.errors, p.skipped = 0, 0, 0, 0, nil
+	p.mu.Unlock()
+
+	histReconcilePass.Observe(took.Seconds())
+	if !failed {
+		gaugeLastReconcile.SetToCurrentTime()
+	}
+	if quiet {
+		lg.WithFields(fields).Debug("reconcile pass finished")
+		return
+	}
+	lg.WithFields(fields).Info("reconcile pass finished")
+}
+
+// lastFinished returns when the last pass ended, or the zero time.
+func (p *reconcilePass) lastFinished() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.finished
+}
+
+// skip records why a non-compliant pod is left alone.
+func (r *reconciler) skip(reason string) {
+	ctrReconcileSkipped.WithLabelValues(reason).Inc()
+	r.pass.tally(func(p *reconcilePass) { p.skipped[reason]++ })
+}
+
+// changed records a deletion the API server refused because the pod is no
+// longer the one judged, e.g. a StatefulSet recreated it under the same name.
+// The pod is looked at again as its informer catches up.
+func (r *reconciler) changed(lg logrus.FieldLogger, pod corev1.Pod) {
+	lg.WithField("skipReason", "changed").Info("pod changed since it was judged; not deleting it")
+	r.deleted("conflict")
+	r.skip("changed")
+	r.requeue(pod.Namespace+"/"+pod.Name, time.Second)
+}
+
+// deleted records the outcome of deleting or evicting a pod: succeeded,
+// failed, blocked by a disruption budget or conflict.
+func (r *reconciler) deleted(result string) {
+	ctrReconcileDeletions.WithLabelValues(result).Inc()
+	if result == "succeeded" {
+		r.pass.tally(func(p *reconcilePass) { p.deleted++ })
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+
+	"github.com/microcumulus/ca-injector/mutate"
+)
+
+// patches caches the patches of pod creations by patchKey, since the
+// replicas of a workload are admitted with the same patch over and over. It
+// is emptied whenever the config changes.
+var patches patchCache
+
+// patchKey returns the key of the pod's patch: mutate.PatchKey, along with
+// the resource version of the secret or config map it mounts, so a patch made
+// while the CA was missing or before it changed is never reused.
+func patchKey(secrets corelisters.SecretLister, pod corev1.Pod, cfg mutate.Config) string {
+	version := "none"
+	switch {
+	case cfg.SecretName != "" && secrets != nil:
+		if s, err := secrets.Secrets(pod.Namespace).Get(cfg.SecretName); err == nil {
+			version = "secret:" + s.ResourceVersion
+		}
+	case cfg.ConfigMapName != "" && configMapLister != nil:
+		if cm, err := configMapLister.ConfigMaps(pod.Namespace).Get(cfg.ConfigMapName); err == nil {
+			version = "configmap:" + cm.ResourceVersion
+		}
+	}
+	return mutate.PatchKey(pod, cfg) + "/" + version
+}
+
+// cachedPatch is a patch along with its warnings and its JSON.
+type cachedPatch struct {
+	key      string
+	patch    []mutate.PatchOp
+	warnings []string
+	bytes    []byte
+}
+
+// patchCache is a least recently used cache of patches. The zero value caches
+// nothing until reset gives it a size.
+type patchCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// reset empties the cache and makes it hold up to size patches; 0 disables
+// it.
+func (c *patchCache) reset(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size = size
+	c.order = list.New()
+	c.entries = map[string]*list.Element{}
+	gaugePatchCacheEntries.Set(0)
+}
+
+// get returns the cached patch for the key, or nil.
+func (c *patchCache) get(key string) *cachedPatch {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= 0 {
+		return nil
+	}
+	el, ok := c.entries[key]
+	if !ok {
+		ctrPatchCache.WithLabelValues("miss").Inc()
+		return nil
+	}
+	ctrPatchCache.WithLabelValues("hit").Inc()
+	c.order.MoveToFront(el)
+	return el.Value.(*cachedPatch)
+}
+
+// add caches the patch, evicting the least recently used one if the cache is
+// full. Callers must not modify the patch or its warnings afterwards.
+func (c *patchCache) add(p *cachedPatch) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= 0 {
+		return
+	}
+	if el, ok := c.entries[p.key]; ok {
+		el.Value = p
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[p.key] = c.order.PushFront(p)
+	for c.order.Len() > c.size {
+		el := c.order.Back()
+		c.order.Remove(el)
+		delete(c.entries, el.Value.(*cachedPatch).key)
+	}
+	gaugePatchCacheEntries.Set(float64(c.order.Len()))
+}
+
+// marshalPatch returns the patch as JSON.
+func marshalPatch(ctx context.Context, patch []mutate.PatchOp) []byte {
+	_, span := tracer.Start(ctx, "marshal patch")
+	defer span.End()
+	bs, _ := json.Marshal(patch)
+	return bs
+}
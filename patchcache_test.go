@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/microcumulus/ca-injector/mutate"
+)
+
+func TestPatchKeyTracksSecretVersion(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	secrets := corelisters.NewSecretLister(indexer)
+	pod := testPod("web", map[string]string{label: "corp-ca"})
+	cfg := mutate.Config{SecretName: "corp-ca"}
+
+	missing := patchKey(secrets, pod, cfg)
+	secret := testSecret("team", "corp-ca")
+	if err := indexer.Add(secret); err != nil {
+		t.Fatal(err)
+	}
+	v1 := patchKey(secrets, pod, cfg)
+	secret = secret.DeepCopy()
+	secret.ResourceVersion = "2"
+	if err := indexer.Update(secret); err != nil {
+		t.Fatal(err)
+	}
+	v2 := patchKey(secrets, pod, cfg)
+
+	if missing == v1 || v1 == v2 || missing == v2 {
+		t.Errorf("keys do not track the secret: missing %s, v1 %s, v2 %s", missing, v1, v2)
+	}
+	if again := patchKey(secrets, pod, cfg); again != v2 {
+		t.Errorf("key of an unchanged secret changed: %s, then %s", v2, again)
+	}
+}
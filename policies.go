@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/microcumulus/ca-injector/mutate"
+)
+
+var policyGVR = schema.GroupVersionResource{Group: "microcumul.us", Version: "v1alpha1", Resource: "cainjectionpolicies"}
+
+// policies is nil unless CA_INJECTION_POLICIES is set; it is shared by the
+// webhook and the reconciler so both judge pods the same way.
+var policies *policyResolver
+
+// caPolicySpec is the spec of a CAInjectionPolicy.
+type caPolicySpec struct {
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	PodSelector       *metav1.LabelSelector `json:"podSelector,omitempty"`
+	// SecretName is copied into the pod's namespace like the annotation's;
+	// it may be namespace/name.
+	SecretName string `json:"secretName,omitempty"`
+	// ConfigMap is a config map in the pod's namespace.
+	ConfigMap *struct {
+		Name string `json:"name"`
+		Key  string `json:"key,omitempty"`
+	} `json:"configMap,omitempty"`
+	MountPath string   `json:"mountPath,omitempty"`
+	Env       []string `json:"env,omitempty"`
+}
+
+// caPolicy is a CAInjectionPolicy with its selectors parsed.
+type caPolicy struct {
+	name      string
+	spec      caPolicySpec
+	namespace labels.Selector
+	pod       labels.Selector
+}
+
+// policyResolver matches pods against the CAInjectionPolicies in the cluster.
+// Its informers keep it current, so policy changes apply without a restart.
+type policyResolver struct {
+	factory    dynamicinformer.DynamicSharedInformerFactory
+	policies   cache.GenericLister
+	namespaces corelisters.NamespaceLister
+	configMaps corelisters.ConfigMapLister
+}
+
+// newPolicyResolver registers informers for CAInjectionPolicies with a new
+// factory and for namespaces and config maps with the given one; both must be
+// started afterwards.
+func newPolicyResolver(dyn dynamic.Interface, factory informers.SharedInformerFactory) *policyResolver {
+	f := dynamicinformer.NewDynamicSharedInformerFactory(dyn, 10*time.Minute)
+	return &policyResolver{
+		factory:    f,
+		policies:   f.ForResource(policyGVR).Lister(),
+		namespaces: factory.Core().V1().Namespaces().Lister(),
+		configMaps: factory.Core().V1().ConfigMaps().Lister(),
+	}
+}
+
+// onChange calls fn whenever a policy is added, changed or removed.
+func (pr *policyResolver) onChange(fn func()) {
+	pr.factory.ForResource(policyGVR).Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { fn() },
+		UpdateFunc: func(_, _ interface{}) { fn() },
+		DeleteFunc: func(interface{}) { fn() },
+	})
+}
+
+// policyFor returns the policy that applies to the pod, if any. A pod naming
+// a secret, issuer, bundle or inline CA itself is left to its annotations.
+func policyFor(cfg *viper.Viper, pod corev1.Pod) *caPolicy {
+	if policies == nil || requestedSecret(pod) != "" || issuerFor(cfg, pod) != "" || inlineSecretName(pod) != "" {
+		return nil
+	}
+	if cfg.GetBool("trust.manager.bundles") && annotation(pod.Annotations, bundleLabel) != "" {
+		return nil
+	}
+	return policies.match(pod)
+}
+
+// policyConfigMap returns the config map the pod's policy injects, if it
+// injects one rather than a secret.
+func policyConfigMap(cfg *viper.Viper, pod corev1.Pod) string {
+	if p := policyFor(cfg, pod); p != nil && p.spec.SecretName == "" && p.spec.ConfigMap != nil {
+		return p.spec.ConfigMap.Name
+	}
+	return ""
+}
+
+// policyRules puts the policy's variables in place of the default image rule,
+// so a rule for an image still wins.
+func policyRules(p *caPolicy) []mutate.Rule {
+	var rules []mutate.Rule
+	for _, r := range imageRules {
+		if r.Image != nil {
+			rules = append(rules, r)
+		}
+	}
+	return append(rules, mutate.Rule{Name: "policy " + p.name, Env: p.spec.Env})
+}
+
+// match returns the first policy, by name, selecting both the pod and its
+// namespace. Invalid policies are logged and skipped.
+func (pr *policyResolver) match(pod corev1.Pod) *caPolicy {
+	objs, err := pr.policies.List(labels.Everything())
+	if err != nil {
+		lg.WithError(err).Error("could not list CA injection policies")
+		return nil
+	}
+	var ps []*caPolicy
+	for _, obj := range objs {
+		p, err := parsePolicy(obj)
+		if err != nil {
+			lg.WithError(err).Warn("ignoring invalid CA injection policy")
+			continue
+		}
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].name < ps[j].name })
+
+	var nsLabels labels.Set
+	for _, p := range ps {
+		if !p.pod.Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+		if nsLabels == nil {
+			ns, err := pr.namespaces.Get(pod.Namespace)
+			if err != nil {
+				lg.WithError(err).WithField("namespace", pod.Namespace).Warn("could not get namespace to match CA injection policies")
+				return nil
+			}
+			nsLabels = labels.Set(ns.Labels)
+		}
+		if p.namespace.Matches(nsLabels) {
+			return p
+		}
+	}
+	return nil
+}
+
+func parsePolicy(obj runtime.Object) (*caPolicy, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected type %T for CA injection policy", obj)
+	}
+	p := &caPolicy{name: u.GetName()}
+	spec, _, _ := unstructured.NestedMap(u.Object, "spec")
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(spec, &p.spec); err != nil {
+		return nil, fmt.Errorf("error parsing CA injection policy %q: %w", p.name, err)
+	}
+	if p.spec.SecretName == "" && (p.spec.ConfigMap == nil || p.spec.ConfigMap.Name == "") {
+		return nil, fmt.Errorf("CA injection policy %q names neither a secret nor a config map", p.name)
+	}
+
+	var err error
+	if p.namespace, err = selector(p.spec.NamespaceSelector); err != nil {
+		return nil, fmt.Errorf("invalid namespaceSelector in CA injection policy %q: %w", p.name, err)
+	}
+	if p.pod, err = selector(p.spec.PodSelector); err != nil {
+		return nil, fmt.Errorf("invalid podSelector in CA injection policy %q: %w", p.name, err)
+	}
+	return p, nil
+}
+
+// selector converts a label selector, where an absent one selects everything.
+func selector(ls *metav1.LabelSelector) (labels.Selector, error) {
+	if ls == nil {
+		return labels.Everything(), nil
+	}
+	return metav1.LabelSelectorAsSelector(ls)
+}
+
+// checkConfigMap verifies the policy's config map exists in the namespace with
+// its key.
+func (pr *policyResolver) checkConfigMap(namespace string, p *caPolicy) error {
+	cm, err := pr.configMaps.ConfigMaps(namespace).Get(p.spec.ConfigMap.Name)
+	if err != nil {
+		return fmt.Errorf("config map %q of CA injection policy %q not found in namespace %q: %w", p.spec.ConfigMap.Name, p.name, namespace, err)
+	}
+	key := first(p.spec.ConfigMap.Key, "ca.crt")
+	if _, ok := cm.Data[key]; !ok {
+		return fmt.Errorf("config map %q in namespace %q has no %q key", p.spec.ConfigMap.Name, namespace, key)
+	}
+	return nil
+}
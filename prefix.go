@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/microcumulus/ca-injector/mutate"
+)
+
+// workloadKeys are the annotations and labels read from pods and namespaces,
+// which ANNOTATION_PREFIX moves to another domain along with the markers.
+// Those on the secrets the injector manages itself stay where they are.
+var workloadKeys = []*string{
+	&label, &overrideEnvLabel, &optionalLabel, &modeLabel, &mergePathLabel, &modeBitsLabel,
+	&bundleLabel, &dirLabel, &issuerLabel, &javaLabel, &pemLabel, &urlLabel,
+	&restartOnRotateLabel, &namespaceDefaultLabel, &envFromLabel,
+	&kubeRootLabel, &keyLabel,
+}
+
+// legacyPrefix is the default prefix while it is still honored alongside
+// ANNOTATION_PREFIX, or empty.
+var legacyPrefix string
+
+// setAnnotationPrefix applies ANNOTATION_PREFIX and LEGACY_ANNOTATION_PREFIX.
+// It must be called before anything is read from pods.
+func setAnnotationPrefix(cfg *viper.Viper) error {
+	prefix := cfg.GetString("annotation.prefix")
+	if errs := validation.IsDNS1123Subdomain(prefix); len(errs) > 0 {
+		return fmt.Errorf("invalid ANNOTATION_PREFIX %q: %s", prefix, strings.Join(errs, "; "))
+	}
+	for _, k := range workloadKeys {
+		*k = prefix + (*k)[strings.Index(*k, "/"):]
+	}
+	mutate.SetAnnotationPrefix(prefix)
+
+	legacyPrefix = ""
+	if prefix != mutate.DefaultAnnotationPrefix && cfg.GetBool("legacy.annotation.prefix") {
+		legacyPrefix = mutate.DefaultAnnotationPrefix
+	}
+	return nil
+}
+
+// annotation returns the value of the annotation or label key, falling back
+// to its legacy name while that is honored.
+func annotation(m map[string]string, key string) string {
+	v, _ := lookupAnnotation(m, key)
+	return v
+}
+
+func lookupAnnotation(m map[string]string, key string) (string, bool) {
+	if v, ok := m[key]; ok {
+		return v, true
+	}
+	if legacy := legacyKey(key); legacy != "" {
+		v, ok := m[legacy]
+		return v, ok
+	}
+	return "", false
+}
+
+// legacyKey returns the name of key under the legacy prefix, or the empty
+// string if that is not honored.
+func legacyKey(key string) string {
+	if legacyPrefix == "" {
+		return ""
+	}
+	return legacyPrefix + key[strings.Index(key, "/"):]
+}
@@ -0,0 +1,716 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	clientscheme "k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/microcumulus/ca-injector/mutate"
+)
+
+// reconcileMaxBackoff caps how long a failing key waits before it is retried.
+const reconcileMaxBackoff = 5 * time.Minute
+
+// injectedEventMaxAge keeps CAInjected events to recently created pods, so
+// that a restart of the injector doesn't emit one for every existing pod.
+const injectedEventMaxAge = 10 * time.Minute
+
+// reconciler deletes pods which request CA injection but were admitted
+// without it (e.g. while the webhook was unavailable), so that their
+// controllers recreate them through the webhook.
+type reconciler struct {
+	cs         kubernetes.Interface
+	pods       map[string]corelisters.PodLister
+	secrets    corelisters.SecretLister
+	synced     []cache.InformerSynced
+	factories  []informers.SharedInformerFactory
+	namespaces namespaceFilter
+	// ownNs is the injector's own namespace, which is always excluded.
+	ownNs string
+
+	// queues are only set while Run is processing, so that a replica which
+	// is not the leader doesn't accumulate work. Each has a worker of its
+	// own and holds the keys of some namespaces.
+	mu     sync.Mutex
+	queues []workqueue.RateLimitingInterface
+
+	// issuers and bundles are nil unless cert-manager issuer and
+	// trust-manager Bundle support are enabled.
+	issuers *issuerResolver
+	bundles *bundleResolver
+
+	recorder record.EventRecorder
+	cfg      *viper.Viper
+	budget   deleteBudget
+
+	// announced holds the pods a CAInjected event was recorded for.
+	announcedMu sync.Mutex
+	announced   map[types.UID]bool
+
+	// noncompliant holds what the pods last seen without the CA miss, by
+	// key.
+	noncompliantMu sync.Mutex
+	noncompliant   map[string]*podReport
+
+	pass reconcilePass
+}
+
+// newReconciler registers pod informers which enqueue pods on add, update and
+// every resync interval. When the reconciler is limited to an explicit list of
+// namespaces it watches just those, otherwise it registers a cluster-wide
+// informer with the given factory, which must be started afterwards.
+func newReconciler(cs kubernetes.Interface, factory informers.SharedInformerFactory, issuers *issuerResolver, bundles *bundleResolver, cfg *viper.Viper) *reconciler {
+	r := &reconciler{
+		cfg:          cfg,
+		cs:           cs,
+		issuers:      issuers,
+		bundles:      bundles,
+		pods:         map[string]corelisters.PodLister{},
+		announced:    map[types.UID]bool{},
+		noncompliant: map[string]*podReport{},
+		secrets:      factory.Core().V1().Secrets().Lister(),
+		namespaces:   newNamespaceFilter(cfg.GetString("reconcile.namespaces"), cfg.GetString("reconcile.exclude.namespaces")),
+		ownNs:        podNamespace(cfg),
+	}
+
+	// The recorder correlates repeated events into a single object with an
+	// increasing count rather than creating one per pass.
+	bc := record.NewBroadcaster()
+	bc.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cs.CoreV1().Events("")})
+	r.recorder = bc.NewRecorder(clientscheme.Scheme, corev1.EventSource{Component: "ca-injector"})
+
+	resync := cfg.GetDuration("reconcile.interval")
+	watch := func(ns string, f informers.SharedInformerFactory) {
+		inf := f.Core().V1().Pods().Informer()
+		inf.AddEventHandlerWithResyncPeriod(cache.ResourceEventHandlerFuncs{
+			AddFunc: r.enqueue,
+			UpdateFunc: func(_, obj interface{}) {
+				r.enqueue(obj)
+			},
+			DeleteFunc: r.forget,
+		}, resync)
+		r.pods[ns] = f.Core().V1().Pods().Lister()
+		r.synced = append(r.synced, inf.HasSynced)
+	}
+
+	// Copies of secrets from other namespaces follow their source, and pods
+	// which opted in are restarted when their secret rotates.
+	factory.Core().V1().Secrets().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, obj interface{}) {
+			r.enqueueCopies(obj)
+			r.enqueueRotated(old, obj)
+		},
+		DeleteFunc: r.enqueueCopies,
+	})
+	// Pods asking for the default CA follow their namespace's.
+	factory.Core().V1().Namespaces().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: r.enqueueNamespace,
+	})
+	if issuers != nil {
+		issuers.onChange(r.enqueueIssuerCopies)
+	}
+	if policies != nil {
+		// Any pod may be selected by the changed policy, or no longer be.
+		policies.onChange(r.enqueueAll)
+	}
+
+	nss := r.namespaces.literal()
+	if len(nss) == 0 {
+		watch(metav1.NamespaceAll, factory)
+		return r
+	}
+	for _, ns := range nss {
+		f := informers.NewSharedInformerFactoryWithOptions(cs, resync, informers.WithNamespace(ns))
+		r.factories = append(r.factories, f)
+		watch(ns, f)
+	}
+	return r
+}
+
+func (r *reconciler) enqueue(obj interface{}) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || !r.namespaces.allowed(pod.Namespace) {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	r.requeue(key, 0)
+}
+
+// enqueueAll queues every cached pod.
+func (r *reconciler) enqueueAll() {
+	for _, l := range r.pods {
+		pods, err := l.List(labels.Everything())
+		if err != nil {
+			lg.WithError(err).Error("could not list cached pods")
+			continue
+		}
+		for _, pod := range pods {
+			r.enqueue(pod)
+		}
+	}
+}
+
+// requeue schedules the pod key to be looked at again after d, if the
+// reconciler is running.
+func (r *reconciler) requeue(key string, d time.Duration) {
+	r.mu.Lock()
+	qs := r.queues
+	r.mu.Unlock()
+	if len(qs) > 0 {
+		qs[shard(key, len(qs))].AddAfter(key, d)
+	}
+}
+
+// shard returns which of n queues holds the key, by its namespace, so the
+// pods and copies of a namespace are handled one after the other.
+func shard(key string, n int) int {
+	ns, _, _ := cache.SplitMetaNamespaceKey(strings.TrimPrefix(key, copyKeyPrefix))
+	h := fnv.New32a()
+	h.Write([]byte(ns))
+	return int(h.Sum32() % uint32(n))
+}
+
+// idle reports whether no queue holds keys ready to be handled.
+func (r *reconciler) idle() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, q := range r.queues {
+		if q.Len() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// podLister returns the lister which holds pods for the namespace.
+func (r *reconciler) podLister(ns string) corelisters.PodLister {
+	if l, ok := r.pods[ns]; ok {
+		return l
+	}
+	return r.pods[metav1.NamespaceAll]
+}
+
+// Run processes pods until ctx is cancelled, finishing the pod in hand before
+// returning. It may be called again after it returns, e.g. when leadership is
+// regained.
+func (r *reconciler) Run(ctx context.Context) {
+	for _, f := range r.factories {
+		f.Start(ctx.Done())
+	}
+	if !cache.WaitForCacheSync(ctx.Done(), r.synced...) {
+		lg.Error("could not sync pod cache")
+		return
+	}
+
+	cfgMu.RLock()
+	interval := r.cfg.GetDuration("reconcile.interval")
+	workers := r.cfg.GetInt("reconcile.workers")
+	cfgMu.RUnlock()
+	if workers < 1 {
+		workers = 1
+	}
+	qs := make([]workqueue.RateLimitingInterface, workers)
+	for i := range qs {
+		qs[i] = workqueue.NewNamedRateLimitingQueue(rateLimiter(), fmt.Sprintf("pods-%d", i))
+	}
+	r.mu.Lock()
+	r.queues = qs
+	r.mu.Unlock()
+
+	// Informer notifications were dropped while not running, so start from
+	// everything in the cache.
+	r.enqueueAll()
+
+	lg.WithField("workers", workers).Info("reconciler started")
+	gaugeLastReconcile.SetToCurrentTime()
+	var wg sync.WaitGroup
+	wg.Add(len(qs) + 1)
+	for _, q := range qs {
+		go func(q workqueue.RateLimitingInterface) {
+			defer wg.Done()
+			wait.Until(func() {
+				for r.processNext(ctx, q) {
+				}
+			}, time.Second, ctx.Done())
+		}(q)
+	}
+	go func() {
+		defer wg.Done()
+		wait.Until(func() {
+			cfgMu.RLock()
+			defer cfgMu.RUnlock()
+			r.collectInline(ctx)
+		}, interval, ctx.Done())
+	}()
+
+	<-ctx.Done()
+	r.mu.Lock()
+	r.queues = nil
+	r.mu.Unlock()
+	for _, q := range qs {
+		q.ShutDown()
+	}
+	wg.Wait()
+	lg.Info("reconciler stopped")
+}
+
+func (r *reconciler) processNext(ctx context.Context, q workqueue.RateLimitingInterface) bool {
+	key, quit := q.Get()
+	if quit {
+		return false
+	}
+	defer q.Done(key)
+	r.pass.begin()
+	defer func() {
+		r.pass.end(r.idle())
+	}()
+
+	ctx, span := tracer.Start(ctx, "reconcile", trace.WithAttributes(attribute.String("reconcile.key", key.(string))))
+	defer span.End()
+
+	err := r.syncSafely(ctx, key.(string))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		kind := "pod"
+		if strings.HasPrefix(key.(string), copyKeyPrefix) {
+			kind = "copy"
+		}
+		ctrReconcileErrors.WithLabelValues(kind).Inc()
+		r.pass.tally(func(p *reconcilePass) { p.errors++ })
+		lg.WithError(err).WithField("key", key).WithField("retries", q.NumRequeues(key)).Error("error reconciling; retrying with backoff")
+		q.AddRateLimited(key)
+		return true
+	}
+	q.Forget(key)
+	gaugeLastReconcile.SetToCurrentTime()
+	return true
+}
+
+// syncSafely syncs the key under cfgMu, turning a panic into an error so one
+// bad pod only fails itself rather than the worker and the pass.
+func (r *reconciler) syncSafely(ctx context.Context, key string) (err error) {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic reconciling: %v", p)
+		}
+	}()
+	return r.sync(ctx, key)
+}
+
+// rateLimiter backs failing keys off exponentially up to reconcileMaxBackoff,
+// so an API server outage neither spins the reconciler nor leaves keys
+// unretried for long once it recovers. The overall bucket is client-go's
+// default.
+func rateLimiter() workqueue.RateLimiter {
+	return workqueue.NewMaxOfRateLimiter(
+		workqueue.NewItemExponentialFailureRateLimiter(5*time.Millisecond, reconcileMaxBackoff),
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+	)
+}
+
+func (r *reconciler) sync(ctx context.Context, key string) error {
+	if strings.HasPrefix(key, copyKeyPrefix) {
+		return r.syncCopy(ctx, strings.TrimPrefix(key, copyKeyPrefix))
+	}
+
+	ns, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	l := r.podLister(ns)
+	if l == nil || !r.namespaces.allowed(ns) {
+		return nil
+	}
+
+	pod, err := l.Pods(ns).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error getting pod from cache: %w", err)
+	}
+
+	ctrReconcileExamined.Inc()
+	r.pass.tally(func(p *reconcilePass) { p.examined++ })
+	return r.handle(ctx, *pod)
+}
+
+// compliant reports whether the pod either does not request injection or is
+// injected as the webhook would inject it now: the webhook would not patch it
+// any further. Containers the webhook leaves alone, e.g. because they mount
+// something else at /ssl, do not count. Pods made from an injected template
+// are left to their workload, and Windows pods unless WINDOWS_POLICY=inject.
+func (r *reconciler) compliant(pod corev1.Pod) bool {
+	if secretName(r.cfg, pod) == "" && bundleFor(r.cfg, pod) == "" && policyConfigMap(r.cfg, pod) == "" {
+		return true
+	}
+	if mutate.FromTemplate(pod) || skipsWindows(r.cfg, pod) {
+		return true
+	}
+	patch, _, err := mutate.BuildPatch(pod, r.mutateConfig(pod))
+	return err == nil && len(patch) == 0
+}
+
+// mutateConfig resolves how the webhook would inject the CA into the pod now.
+func (r *reconciler) mutateConfig(pod corev1.Pod) mutate.Config {
+	mcfg := mutateConfig(r.cfg, r.bundles, pod)
+	mcfg.EnvFrom = envFromSources(r.secrets, pod)
+	return mcfg
+}
+
+// skipReason returns why a non-compliant pod should nonetheless be left
+// alone, or the empty string.
+func skipReason(cfg *viper.Viper, pod corev1.Pod) string {
+	owner := metav1.GetControllerOf(&pod)
+	switch {
+	case pod.DeletionTimestamp != nil:
+		return "terminating"
+	case pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed:
+		return "completed"
+	case pod.Annotations[corev1.MirrorPodAnnotationKey] != "" || owner != nil && owner.Kind == "Node":
+		// The kubelet recreates static pods from their manifest as they were.
+		return "mirror"
+	case owner != nil && owner.Kind == "DaemonSet" && cfg.GetBool("reconcile.skip.daemonsets"):
+		return "daemonset"
+	}
+	return ""
+}
+
+// handle checks a single pod and deletes it if it is not compliant.
+func (r *reconciler) handle(ctx context.Context, pod corev1.Pod) error {
+	lg := lg.WithFields(logrus.Fields{
+		"pod.Name":      pod.Name,
+		"pod.Namespace": pod.Namespace,
+	})
+
+	if !r.namespaces.allowed(pod.Namespace) {
+		lg.Debug("namespace is out of scope for the reconciler")
+		return nil
+	}
+
+	secret := secretName(r.cfg, pod)
+	bundle := bundleFor(r.cfg, pod)
+	cm := policyConfigMap(r.cfg, pod)
+	switch {
+	case secret == "" && bundle == "" && cm == "":
+		lg.Debug("did not find annotation or label " + label)
+		r.track(pod.Namespace, pod.Name, nil)
+		return nil
+	case namespaceExcluded(r.cfg, r.ownNs, pod.Namespace):
+		lg.WithField("skipReason", "excluded_namespace").Debug("not reconciling pod in excluded namespace")
+		r.skip("excluded_namespace")
+		return nil
+	case cm != "":
+		// Config maps of policies are not copied; there is nothing to sync.
+	case bundle != "":
+		// Without the Bundle there is no telling what the pod should mount.
+		if _, err := r.bundles.target(bundle); err != nil {
+			lg.WithError(err).Warn("could not resolve bundle; leaving pod alone")
+			return nil
+		}
+	case observing(r.cfg):
+		if names := syncedSecrets(r.cfg, pod, secret); len(names) > 0 {
+			lg.WithField("secrets", names).Debug("audit or warn mode; not syncing secrets")
+		}
+	default:
+		var err error
+		if iss := issuerFor(r.cfg, pod); iss != "" {
+			err = r.issuers.sync(ctx, r.cs, pod.Namespace, iss)
+		} else if usesInline(secret, pod) {
+			err = syncInline(ctx, r.cfg, r.cs, r.secrets, pod)
+		} else {
+			err = syncSecretCopy(ctx, r.cs, r.secrets, pod.Namespace, secret)
+		}
+		if err != nil {
+			lg.WithError(err).Error("could not sync secret copy")
+		}
+
+		if wantsKubeRoot(pod) {
+			if err := syncKubeRootBundle(ctx, r.cs, r.secrets, pod.Namespace, localSecretName(pod.Namespace, secret)); err != nil {
+				lg.WithError(err).Error("could not sync kube-root-ca.crt bundle secret")
+			}
+		} else if wantsDir(pod) {
+			if err := syncCertDir(ctx, r.cs, r.secrets, pod.Namespace, localSecretName(pod.Namespace, secret)); err != nil {
+				lg.WithError(err).Error("could not sync certificate directory secret")
+			}
+		} else if wantsJava(pod) {
+			if err := syncTruststore(ctx, r.cs, r.secrets, pod.Namespace, localSecretName(pod.Namespace, secret)); err != nil {
+				lg.WithError(err).Error("could not sync java truststore secret")
+			}
+		}
+	}
+
+	compliant := r.compliant(pod)
+	if compliant {
+		r.track(pod.Namespace, pod.Name, nil)
+	} else {
+		r.track(pod.Namespace, pod.Name, &podReport{
+			Name:    pod.Name,
+			Secret:  first(injectedSecretName(r.cfg, pod), bundle, cm),
+			Created: pod.CreationTimestamp.Time,
+			Missing: mutate.Missing(pod, r.mutateConfig(pod)),
+		})
+	}
+	stale := compliant && r.rotated(pod)
+	if compliant && !stale {
+		lg.Debug("found volume matching secret from annotation")
+		if r.cfg.GetBool("emit.events") {
+			r.announce(pod, first(injectedSecretName(r.cfg, pod), bundle, cm))
+		}
+		return nil
+	}
+
+	r.pass.tally(func(p *reconcilePass) { p.noncompliant++ })
+
+	// why goes in logs, and problem in events.
+	why, eventReason := "CA mount not found", "CertAuthorityMissing"
+	problem := fmt.Sprintf("pod %q requests CA secret %q but has no %q volume from the ca-injector webhook",
+		pod.Name, first(injectedSecretName(r.cfg, pod), bundle, cm), mutate.VolumeName(pod, mutateConfig(r.cfg, r.bundles, pod)))
+	if stale {
+		why, eventReason = "CA secret rotated", "CertAuthorityRotated"
+		problem = fmt.Sprintf("pod %q was injected before CA secret %q rotated", pod.Name, injectedSecretName(r.cfg, pod))
+	}
+
+	if annotation(pod.Annotations, mutate.InjectedAnnotation) == "true" && !stale {
+		// Injected once, but the secret it asks for has changed since.
+		lg = lg.WithField("injectedSecret", annotation(pod.Annotations, mutate.InjectedSecretAnnotation))
+	}
+
+	if reason := skipReason(r.cfg, pod); reason != "" {
+		lg.WithField("skipReason", reason).Debug("not deleting non-compliant pod")
+		r.skip(reason)
+		if reason == "daemonset" {
+			fix := "fix the DaemonSet's template and roll it out instead"
+			if stale {
+				fix = "restart the DaemonSet instead"
+			}
+			r.recorder.Eventf(r.eventObject(pod), corev1.EventTypeWarning, eventReason,
+				"%s; ca-injector does not delete DaemonSet pods, %s", problem, fix)
+		}
+		return nil
+	}
+	if age := time.Since(pod.CreationTimestamp.Time); age < r.cfg.GetDuration("reconcile.min.age") && !stale {
+		// The pod may simply not have been observed with its mutation yet;
+		// look again once it is old enough.
+		lg.WithField("skipReason", "too_young").Debug("not deleting non-compliant pod")
+		r.skip("too_young")
+		r.requeue(pod.Namespace+"/"+pod.Name, r.cfg.GetDuration("reconcile.min.age")-age)
+		return nil
+	}
+
+	// Events go on the controller when there is one, since the pod itself is
+	// about to disappear. Only pods a controller recreates are restarted on
+	// rotation.
+	owner := metav1.GetControllerOf(&pod)
+	if owner == nil && (stale || !r.cfg.GetBool("reconcile.delete.unmanaged")) {
+		lg.WithField("skipReason", "unmanaged").Warn("not deleting unmanaged pod; " + why)
+		ctrUnmanaged.WithLabelValues(pod.Namespace).Inc()
+		r.skip("unmanaged")
+		r.recorder.Eventf(&pod, corev1.EventTypeWarning, eventReason,
+			"%s; it has no controller to recreate it, so it must be recreated manually", problem)
+		return nil
+	}
+
+	if auditMode(r.cfg) {
+		lg.Info("audit mode; would delete pod, " + why)
+		return nil
+	}
+	if reconcilerMode(r.cfg) == "warn" {
+		lg.Info("reconciler in warn mode; would delete pod, " + why)
+		r.recorder.Eventf(r.eventObject(pod), corev1.EventTypeWarning, eventReason,
+			"%s; it would be deleted, but RECONCILER_MODE is warn", problem)
+		return nil
+	}
+
+	var ownerUID types.UID
+	if owner != nil {
+		ownerUID = owner.UID
+	}
+	ok, wait, deferred := r.budget.take(time.Now(), ownerUID,
+		r.cfg.GetDuration("reconcile.interval"),
+		r.cfg.GetInt("max.deletes.per.cycle"),
+		r.cfg.GetDuration("min.delete.interval"))
+	if !ok {
+		if deferred {
+			lg.WithField("retryIn", wait).Info("deletion budget exhausted; deferring pod")
+			ctrDeletesDeferred.WithLabelValues(pod.Namespace).Inc()
+		}
+		r.requeue(pod.Namespace+"/"+pod.Name, wait)
+		return nil
+	}
+
+	lg.Info("deleting pod; " + why)
+
+	r.recorder.Eventf(r.eventObject(pod), corev1.EventTypeWarning, eventReason, "%s; pod will be deleted", problem)
+
+	// The pod may have been replaced by one of the same name, or changed,
+	// since it was judged from the cache; only ever delete what was judged.
+	uid, rv := pod.UID, pod.ResourceVersion
+	opts := metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &uid, ResourceVersion: &rv},
+	}
+
+	// Restarts on rotation always respect disruption budgets.
+	if r.cfg.GetBool("reconcile.hard.delete") && !stale {
+		err := r.cs.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, opts)
+		if apierrors.IsConflict(err) {
+			r.changed(lg, pod)
+			return nil
+		}
+		if err != nil && !apierrors.IsNotFound(err) {
+			r.deleted("failed")
+			return fmt.Errorf("error deleting pod: %w", err)
+		}
+		r.deleted("succeeded")
+		ctrDeletes.WithLabelValues(podMetricLabels(r.cfg, pod)...).Inc()
+		return nil
+	}
+
+	err := r.cs.PolicyV1().Evictions(pod.Namespace).Evict(ctx, &policyv1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+		},
+		DeleteOptions: &opts,
+	})
+	switch {
+	case apierrors.IsNotFound(err):
+		return nil
+	case apierrors.IsConflict(err):
+		r.changed(lg, pod)
+		return nil
+	case apierrors.IsTooManyRequests(err):
+		// A PodDisruptionBudget does not allow the eviction right now; try
+		// again next cycle rather than treating it as an error.
+		lg.WithError(err).WithField("skipReason", "pdb_blocked").Info("eviction blocked by disruption budget; requeueing")
+		ctrEvictions.WithLabelValues(pod.Namespace, "blocked").Inc()
+		r.deleted("blocked")
+		r.skip("pdb_blocked")
+		r.requeue(pod.Namespace+"/"+pod.Name, r.cfg.GetDuration("reconcile.interval"))
+		return nil
+	case err != nil:
+		r.deleted("failed")
+		return fmt.Errorf("error evicting pod: %w", err)
+	}
+	r.deleted("succeeded")
+	ctrEvictions.WithLabelValues(pod.Namespace, "evicted").Inc()
+	ctrDeletes.WithLabelValues(podMetricLabels(r.cfg, pod)...).Inc()
+	return nil
+}
+
+// eventObject returns what events about a pod to be deleted go on: its
+// controller when there is one, since the pod itself is about to disappear.
+func (r *reconciler) eventObject(pod corev1.Pod) runtime.Object {
+	owner := metav1.GetControllerOf(&pod)
+	if owner == nil {
+		return &pod
+	}
+	return &corev1.ObjectReference{
+		Kind:       owner.Kind,
+		Namespace:  pod.Namespace,
+		Name:       owner.Name,
+		UID:        owner.UID,
+		APIVersion: owner.APIVersion,
+	}
+}
+
+// track records what the pod is missing, or nil if it is compliant, keeping
+// ca_injector_pods_noncompliant up to date for its namespace.
+func (r *reconciler) track(namespace, name string, report *podReport) {
+	key := namespace + "/" + name
+	r.noncompliantMu.Lock()
+	defer r.noncompliantMu.Unlock()
+	_, was := r.noncompliant[key]
+	if report == nil {
+		delete(r.noncompliant, key)
+	} else {
+		report.Checked = time.Now()
+		r.noncompliant[key] = report
+	}
+	if was == (report != nil) {
+		return
+	}
+	n := 0
+	for k := range r.noncompliant {
+		if strings.HasPrefix(k, namespace+"/") {
+			n++
+		}
+	}
+	gaugeNoncompliant.WithLabelValues(namespace).Set(float64(n))
+}
+
+// announce records a CAInjected event for a recently created injected pod,
+// once.
+func (r *reconciler) announce(pod corev1.Pod, source string) {
+	if time.Since(pod.CreationTimestamp.Time) > injectedEventMaxAge {
+		return
+	}
+	r.announcedMu.Lock()
+	done := r.announced[pod.UID]
+	r.announced[pod.UID] = true
+	r.announcedMu.Unlock()
+	if done {
+		return
+	}
+
+	mcfg := mutateConfig(r.cfg, r.bundles, pod)
+	volName := mutate.VolumeName(pod, mcfg)
+	var ctrs []string
+	for _, ctr := range mutate.Containers(pod) {
+		if mutate.HasMount(ctr, volName, first(mcfg.MountPath, mutate.MountPath)) || mcfg.Env {
+			ctrs = append(ctrs, ctr.Name)
+		}
+	}
+	r.recorder.Eventf(&pod, corev1.EventTypeNormal, "CAInjected",
+		"injected CA from %q into containers %s", source, strings.Join(ctrs, ", "))
+}
+
+// forget drops a deleted pod from the announced set.
+func (r *reconciler) forget(obj interface{}) {
+	if tomb, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tomb.Obj
+	}
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+	r.announcedMu.Lock()
+	delete(r.announced, pod.UID)
+	r.announcedMu.Unlock()
+	r.track(pod.Namespace, pod.Name, nil)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestReconcilerHandle(t *testing.T) {
+	ann := map[string]string{"microcumul.us/injectssl": "corp-ca"}
+	unmanaged := testPod("unmanaged", ann)
+	unmanaged.OwnerReferences = nil
+
+	tests := []struct {
+		name    string
+		pod     corev1.Pod
+		mode    string
+		recMode string
+		deleted bool
+	}{
+		{name: "not annotated", pod: testPod("plain", nil)},
+		{name: "injected", pod: injectedPod(t, testPod("injected", ann), "corp-ca")},
+		{name: "missing the CA", pod: testPod("missing", ann), deleted: true},
+		{name: "unmanaged", pod: unmanaged},
+		{name: "audit mode", pod: testPod("missing", ann), mode: "audit"},
+		{name: "warn mode", pod: testPod("missing", ann), recMode: "warn"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newConfig()
+			cfg.Set("reconcile.hard.delete", true)
+			if tt.mode != "" {
+				cfg.Set("mode", tt.mode)
+			}
+			if tt.recMode != "" {
+				cfg.Set("reconciler.mode", tt.recMode)
+			}
+
+			pod := tt.pod
+			cs := fake.NewSimpleClientset(&pod, testSecret("team", "corp-ca"))
+			r, stop := startReconciler(t, cs, cfg)
+			defer stop()
+
+			if err := r.sync(context.Background(), pod.Namespace+"/"+pod.Name); err != nil {
+				t.Fatal(err)
+			}
+			_, err := cs.CoreV1().Pods(pod.Namespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+			if deleted := apierrors.IsNotFound(err); deleted != tt.deleted {
+				t.Errorf("deleted = %v, want %v", deleted, tt.deleted)
+			}
+		})
+	}
+}
+
+func TestReconcilerWritesSecretsOnlyWhenEnforcing(t *testing.T) {
+	for _, tt := range []struct {
+		mode, recMode string
+		writes        bool
+	}{
+		{mode: "enforce", recMode: "enforce", writes: true},
+		{mode: "audit", recMode: "enforce"},
+		{mode: "enforce", recMode: "warn"},
+	} {
+		t.Run(tt.mode+"/"+tt.recMode, func(t *testing.T) {
+			cfg := newConfig()
+			cfg.Set("secret.source.namespaces", "pki")
+			cfg.Set("mode", tt.mode)
+			cfg.Set("reconciler.mode", tt.recMode)
+
+			pod := testPod("java", map[string]string{
+				"microcumul.us/injectssl":      "pki/corp-ca",
+				"microcumul.us/injectssl-java": "true",
+			})
+			cs := fake.NewSimpleClientset(&pod, testSecret("pki", "corp-ca"))
+			r, stop := startReconciler(t, cs, cfg)
+			defer stop()
+
+			if err := r.sync(context.Background(), pod.Namespace+"/"+pod.Name); err != nil {
+				t.Fatal(err)
+			}
+			written := secretWrites(cs)
+			if got := len(written) > 0; got != tt.writes {
+				t.Errorf("secrets written: %v, want writes %v", written, tt.writes)
+			}
+		})
+	}
+}
+
+// startReconciler returns a reconciler on informers of cs with their caches
+// synced, and a func stopping them.
+func startReconciler(t *testing.T, cs *fake.Clientset, cfg *viper.Viper) (*reconciler, func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	factory := informers.NewSharedInformerFactory(cs, time.Minute)
+	r := newReconciler(cs, factory, nil, nil, cfg)
+	factory.Start(ctx.Done())
+	for typ, ok := range factory.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			t.Fatalf("could not sync %v", typ)
+		}
+	}
+	r.pass.begin()
+	return r, cancel
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// cfgMu is held for writing while a changed config file is applied, and for
+// reading while a reconciler key is handled, so each sees a single generation
+// of the settings. Only the goroutine watching the file writes, and it reads
+// without the lock. Admissions read a snapshot instead; see settings.
+var cfgMu sync.RWMutex
+
+// snapshot holds a copy of the settings for admissions, which wait on the API
+// server and may be abandoned once their deadline passes. Holding cfgMu for
+// as long would hold up reloads, and every reader queued behind them.
+var snapshot atomic.Value
+
+// publishSettings copies the settings in effect into the snapshot. It is
+// called at startup and, once a changed file is applied, by the goroutine
+// watching it.
+func publishSettings(cfg *viper.Viper) {
+	snap := viper.New()
+	for _, k := range cfg.AllKeys() {
+		snap.Set(k, cfg.Get(k))
+	}
+	snapshot.Store(snap)
+}
+
+// settings returns the last published settings, or cfg before the first.
+// Admissions take them once, up front, and use them throughout.
+func settings(cfg *viper.Viper) *viper.Viper {
+	if snap, ok := snapshot.Load().(*viper.Viper); ok {
+		return snap
+	}
+	return cfg
+}
+
+// startupSettings are only read at startup, e.g. into the admission handlers
+// and the reconciler's namespace filter, so changing them in the file takes a
+// restart. Reloads warn about them.
+var startupSettings = []string{
+	"annotation.prefix",
+	"legacy.annotation.prefix",
+	"image.rules.file",
+	"webhook.timeout",
+	"admission.timeout.margin",
+	"admission.timeout.policy",
+	"admission.max.body.bytes",
+	"admission.max.concurrent",
+	"admission.queue.timeout",
+	"admission.overload.policy",
+	"admission.audit.skipped",
+	"reconcile.namespaces",
+	"reconcile.exclude.namespaces",
+	"reconcile.interval",
+	"reconcile.workers",
+	"cert.manager.issuers",
+	"trust.manager.bundles",
+	"ca.injection.policies",
+	"owner.lookup",
+	"kube.root.bundles",
+	"listen.addr",
+	"metrics.addr",
+	"insecure.http",
+}
+
+// configHash is the hash of the config file last applied.
+var configHash string
+
+// setConfigHash records the hash of the applied config file, or of none.
+func setConfigHash(bs []byte) {
+	configHash = "none"
+	if bs != nil {
+		sum := sha256.Sum256(bs)
+		configHash = hex.EncodeToString(sum[:6])
+	}
+	gaugeConfigHash.Reset()
+	gaugeConfigHash.WithLabelValues(configHash).Set(1)
+}
+
+// watchConfig applies the config file whenever it changes, until ctx is
+// cancelled. Invalid files are logged and leave the previous settings in
+// place.
+func watchConfig(ctx context.Context, cfg *viper.Viper) {
+	file := cfg.ConfigFileUsed()
+	if file == "" {
+		return
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		lg.WithError(err).Error("could not watch config file; changes need a restart")
+		return
+	}
+	defer w.Close()
+	// Mounted config maps are updated by swapping a symlink in the
+	// directory, which the file itself never sees.
+	if err := w.Add(filepath.Dir(file)); err != nil {
+		lg.WithError(err).WithField("file", file).Error("could not watch config file; changes need a restart")
+		return
+	}
+	real, _ := filepath.EvalSymlinks(file)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-w.Errors:
+			lg.WithError(err).Warn("error watching config file")
+		case ev := <-w.Events:
+			cur, _ := filepath.EvalSymlinks(file)
+			written := filepath.Clean(ev.Name) == filepath.Clean(file) && ev.Op&(fsnotify.Write|fsnotify.Create) != 0
+			if !written && (cur == "" || cur == real) {
+				continue
+			}
+			real = cur
+			if err := reloadConfig(cfg, file); err != nil {
+				lg.WithError(err).WithFields(logrus.Fields{
+					"file": file,
+					"hash": configHash,
+				}).Error("changed config file is invalid; keeping the previous settings")
+				ctrConfigReloadErrors.Inc()
+			}
+		}
+	}
+}
+
+// reloadConfig validates the file and, if it is valid and changed, swaps it
+// into cfg.
+func reloadConfig(cfg *viper.Viper, file string) error {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+	sum := sha256.Sum256(bs)
+	if hex.EncodeToString(sum[:6]) == configHash {
+		return nil
+	}
+
+	next := newConfig()
+	next.SetConfigType(strings.TrimPrefix(filepath.Ext(file), "."))
+	if err := next.ReadConfig(bytes.NewReader(bs)); err != nil {
+		return fmt.Errorf("error parsing config file: %w", err)
+	}
+	if err := validateConfig(next); err != nil {
+		return err
+	}
+
+	for _, k := range startupSettings {
+		if fmt.Sprint(next.Get(k)) != fmt.Sprint(cfg.Get(k)) {
+			lg.WithField("setting", k).Warn("changed setting only takes effect after a restart")
+		}
+	}
+
+	cfgMu.Lock()
+	cfg.SetConfigType(strings.TrimPrefix(filepath.Ext(file), "."))
+	err = cfg.ReadConfig(bytes.NewReader(bs))
+	if err == nil {
+		publishSettings(cfg)
+	}
+	cfgMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("error applying config file: %w", err)
+	}
+
+	setConfigHash(bs)
+	patches.reset(cfg.GetInt("patch.cache.size"))
+	setupLogging(cfg)
+	setModeInfo(cfg)
+	lg.WithField("file", file).WithField("hash", configHash).Info("applied changed config file")
+	return nil
+}
+
+// configChoices lists the values settings with a fixed set of them accept.
+var configChoices = map[string][]string{
+	"log.level":                 {"debug", "info", "warn", "warning", "error"},
+	"log.format":                {"", "json", "text"},
+	"mode":                      {"enforce", "audit"},
+	"reconciler.mode":           {"enforce", "warn", "off"},
+	"validate.policy":           {"deny", "warn"},
+	"admission.timeout.policy":  {"allow", "deny"},
+	"admission.overload.policy": {"allow", "error"},
+	"secret.missing.policy":     {"warn", "reject"},
+	"secret.name.policy":        {"warn", "deny"},
+	"windows.policy":            {"skip", "inject"},
+}
+
+// validateConfig checks every setting parses as the type of its default, and
+// those with fixed choices hold one. Unknown settings are only warned about.
+func validateConfig(cfg *viper.Viper) error {
+	defaults := newConfig()
+	known := map[string]bool{}
+	for _, k := range defaults.AllKeys() {
+		known[k] = true
+	}
+	var problems []string
+	for _, k := range cfg.AllKeys() {
+		if !known[k] {
+			lg.WithField("setting", k).Warn("unknown setting in config file is ignored")
+			continue
+		}
+		v := cfg.Get(k)
+		switch d := defaults.Get(k).(type) {
+		case bool:
+			if _, err := strconv.ParseBool(fmt.Sprint(v)); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %q is not a boolean", k, v))
+			}
+		case int:
+			if _, err := strconv.Atoi(fmt.Sprint(v)); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %q is not a number", k, v))
+			}
+		case string:
+			if _, err := time.ParseDuration(d); err == nil && d != "" {
+				if _, err := time.ParseDuration(fmt.Sprint(v)); err != nil {
+					problems = append(problems, fmt.Sprintf("%s: %q is not a duration", k, v))
+				}
+			}
+		}
+		if k == "secret.name.pattern" {
+			if _, err := regexp.Compile(fmt.Sprint(v)); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", k, err))
+			}
+		}
+		if choices, ok := configChoices[k]; ok && !oneOf(fmt.Sprint(v), choices) {
+			problems = append(problems, fmt.Sprintf("%s: %q is not one of %s", k, v, strings.Join(choices, ", ")))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("invalid settings: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func oneOf(s string, choices []string) bool {
+	for _, c := range choices {
+		if s == c {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// podReport is what /report says about a pod the reconciler last saw
+// requesting the CA without having it injected.
+type podReport struct {
+	Name    string    `json:"name"`
+	Secret  string    `json:"secret"`
+	Created time.Time `json:"created"`
+	Age     string    `json:"age"`
+	Missing []string  `json:"missing"`
+	// Checked is when the reconciler last looked at the pod.
+	Checked time.Time `json:"checked"`
+}
+
+type namespaceReport struct {
+	Total int         `json:"total"`
+	Pods  []podReport `json:"pods"`
+}
+
+type report struct {
+	Generated time.Time `json:"generated"`
+	// LastPass is when the reconciler last drained its queue, and Running
+	// whether it runs on this replica at all, e.g. as the leader.
+	LastPass   *time.Time                 `json:"lastPass,omitempty"`
+	Running    bool                       `json:"running"`
+	Total      int                        `json:"total"`
+	Namespaces map[string]namespaceReport `json:"namespaces"`
+}
+
+// serveReport lists the non-compliant pods as last seen by the reconciler,
+// optionally only those of the namespace given as ?namespace=. It never looks
+// at the cluster itself.
+func (r *reconciler) serveReport(w http.ResponseWriter, req *http.Request) {
+	only := req.URL.Query().Get("namespace")
+	now := time.Now()
+	out := report{
+		Generated:  now,
+		Namespaces: map[string]namespaceReport{},
+	}
+	r.mu.Lock()
+	out.Running = r.queues != nil
+	r.mu.Unlock()
+	if last := r.pass.lastFinished(); !last.IsZero() {
+		out.LastPass = &last
+	}
+
+	r.noncompliantMu.Lock()
+	for key, p := range r.noncompliant {
+		ns := key[:strings.Index(key, "/")]
+		if only != "" && ns != only {
+			continue
+		}
+		pr := *p
+		pr.Age = now.Sub(pr.Created).Round(time.Second).String()
+		nr := out.Namespaces[ns]
+		nr.Pods = append(nr.Pods, pr)
+		nr.Total++
+		out.Namespaces[ns] = nr
+		out.Total++
+	}
+	r.noncompliantMu.Unlock()
+	for _, nr := range out.Namespaces {
+		sort.Slice(nr.Pods, func(i, j int) bool { return nr.Pods[i].Name < nr.Pods[j].Name })
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		lg.WithError(err).Error("could not write report")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// requestIDHeader carries the ID of a request, from the caller or generated.
+const requestIDHeader = "X-Request-Id"
+
+// loggerKey is the context key of the *logrus.Entry for a request.
+type loggerKey struct{}
+
+// withRequestID serves h with a logger carrying the request's ID in the
+// request context, and echoes the ID in the response. Admission handlers add
+// the review's UID to it.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 64 {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := withLogger(r.Context(), lg.WithField("requestID", id))
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func withLogger(ctx context.Context, e *logrus.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, e)
+}
+
+// requestLogger returns the logger of the request ctx belongs to, or the
+// global one outside of requests.
+func requestLogger(ctx context.Context) *logrus.Entry {
+	if e, ok := ctx.Value(loggerKey{}).(*logrus.Entry); ok {
+		return e
+	}
+	return logrus.NewEntry(lg)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"sort"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+
+	"github.com/microcumulus/ca-injector/mutate"
+)
+
+var restartOnRotateLabel = "microcumul.us/injectssl-restart-on-rotate"
+
+// restartOnRotate reports whether the pod opted in to being restarted when
+// its CA secret's ca.crt changes.
+func restartOnRotate(pod corev1.Pod) bool {
+	return annotation(pod.Annotations, restartOnRotateLabel) == "true"
+}
+
+// caHash returns the hash of the secret's key, ca.crt if empty, or the empty
+// string if there is none.
+func caHash(sl corelisters.SecretLister, namespace, name, key string) string {
+	s, err := sl.Secrets(namespace).Get(name)
+	if err != nil {
+		return ""
+	}
+	ca, ok := s.Data[first(key, "ca.crt")]
+	if !ok {
+		return ""
+	}
+	sum := sha256.Sum256(ca)
+	return hex.EncodeToString(sum[:])
+}
+
+// injectionHash returns the hash to record on a pod which opted in to
+// restarts: that of the secret in its namespace, or of the source if the copy
+// is not cached yet, which holds the same ca.crt.
+func injectionHash(cfg *viper.Viper, sl corelisters.SecretLister, pod corev1.Pod) string {
+	secret := secretName(cfg, pod)
+	if !restartOnRotate(pod) || secret == "" {
+		return ""
+	}
+	key, _ := secretKey(cfg, pod)
+	if h := caHash(sl, pod.Namespace, localSecretName(pod.Namespace, secret), key); h != "" {
+		return h
+	}
+	srcNs, srcName := splitSecretRef(pod.Namespace, secret)
+	return caHash(sl, srcNs, srcName, key)
+}
+
+// rotated reports whether the pod opted in to restarts and was injected with
+// a ca.crt its secret no longer holds. Pods injected without a hash are never
+// considered rotated.
+func (r *reconciler) rotated(pod corev1.Pod) bool {
+	injected := annotation(pod.Annotations, mutate.InjectedHashAnnotation)
+	secret := secretName(r.cfg, pod)
+	if !restartOnRotate(pod) || injected == "" || secret == "" {
+		return false
+	}
+	key, _ := secretKey(r.cfg, pod)
+	cur := caHash(r.secrets, pod.Namespace, localSecretName(pod.Namespace, secret), key)
+	return cur != "" && cur != injected
+}
+
+// enqueueRotated queues the pods which opted in to restarts and mount the
+// secret when the key they mount, usually ca.crt, changes, oldest first.
+func (r *reconciler) enqueueRotated(old, obj interface{}) {
+	prev, ok1 := old.(*corev1.Secret)
+	s, ok2 := obj.(*corev1.Secret)
+	if !ok1 || !ok2 || reflect.DeepEqual(prev.Data, s.Data) || !r.namespaces.allowed(s.Namespace) {
+		return
+	}
+
+	pods, err := r.podLister(s.Namespace).Pods(s.Namespace).List(labels.Everything())
+	if err != nil {
+		lg.WithError(err).Error("could not list cached pods")
+		return
+	}
+	var affected []*corev1.Pod
+	for _, pod := range pods {
+		key, _ := secretKey(r.cfg, *pod)
+		key = first(key, "ca.crt")
+		if restartOnRotate(*pod) && localSecretName(pod.Namespace, secretName(r.cfg, *pod)) == s.Name && !bytes.Equal(prev.Data[key], s.Data[key]) {
+			affected = append(affected, pod)
+		}
+	}
+	sort.Slice(affected, func(i, j int) bool {
+		return affected[i].CreationTimestamp.Before(&affected[j].CreationTimestamp)
+	})
+	if len(affected) > 0 {
+		lg.WithField("secret", s.Namespace+"/"+s.Name).WithField("pods", len(affected)).Info("CA secret rotated; restarting pods which opted in")
+	}
+	for _, pod := range affected {
+		r.enqueue(pod)
+	}
+}
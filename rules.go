@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/microcumulus/ca-injector/mutate"
+)
+
+// imageRules are loaded from IMAGE_RULES_FILE at startup; nil unless
+// configured.
+var imageRules []mutate.Rule
+
+// imageRulesFile is the format of IMAGE_RULES_FILE.
+type imageRulesFile struct {
+	Rules []struct {
+		Name  string   `json:"name"`
+		Image string   `json:"image"`
+		Env   []string `json:"env"`
+	} `json:"rules"`
+	Default *struct {
+		Env []string `json:"env"`
+	} `json:"default"`
+}
+
+// loadImageRules reads the rules in order, with the default rule, if any,
+// last.
+func loadImageRules(file string) ([]mutate.Rule, error) {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading image rules: %w", err)
+	}
+	var f imageRulesFile
+	if err := yaml.UnmarshalStrict(bs, &f); err != nil {
+		return nil, fmt.Errorf("error parsing image rules %s: %w", file, err)
+	}
+
+	var rules []mutate.Rule
+	for i, r := range f.Rules {
+		if r.Image == "" {
+			return nil, fmt.Errorf("image rule %d of %s has no image", i, file)
+		}
+		re, err := regexp.Compile(r.Image)
+		if err != nil {
+			return nil, fmt.Errorf("image rule %d of %s: %w", i, file, err)
+		}
+		rules = append(rules, mutate.Rule{
+			Name:  first(r.Name, r.Image),
+			Image: re,
+			Env:   r.Env,
+		})
+	}
+	if f.Default != nil {
+		rules = append(rules, mutate.Rule{
+			Name: "default",
+			Env:  f.Default.Env,
+		})
+	}
+	return rules, nil
+}
+
+// rulesWantJava reports whether the rule of any of the pod's containers sets
+// JAVA_TOOL_OPTIONS, so the truststore has to be mounted.
+func rulesWantJava(pod corev1.Pod) bool {
+	for _, ctr := range mutate.Containers(pod) {
+		if r := mutate.MatchRule(imageRules, ctr.Image); r != nil && r.Sets(mutate.JavaToolOptions) {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleName returns the name of the rule applying to the container, for logs.
+func ruleName(ctr corev1.Container) string {
+	if r := mutate.MatchRule(imageRules, ctr.Image); r != nil {
+		return r.Name
+	}
+	return "mode"
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// keyLabel names the key of the pod's CA secret which holds the CA, if it is
+// not ca.crt. Only that key is mounted, as ca.crt, so the paths the variables
+// point at stay the same.
+var keyLabel = "microcumul.us/injectssl-key"
+
+// secretKey returns the key of the pod's CA secret to inject, or the empty
+// string for ca.crt. It only applies to secrets in the pod's namespace which
+// are mounted as they are: copies, issuer and inline secrets only ever hold
+// ca.crt, and the truststore, directory and kube-root secrets are built from
+// it. A key which cannot apply is reported and ignored.
+func secretKey(cfg *viper.Viper, pod corev1.Pod) (string, error) {
+	key := annotation(pod.Annotations, keyLabel)
+	if key == "" || key == "ca.crt" {
+		return "", nil
+	}
+	if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+		return "", fmt.Errorf("%s %q is not a valid secret key: %s; using ca.crt", keyLabel, key, strings.Join(errs, "; "))
+	}
+
+	ref, source := resolveSecret(cfg, pod)
+	ns, _ := splitSecretRef(pod.Namespace, ref)
+	env := annotation(pod.Annotations, modeLabel) == "env"
+	switch {
+	case ref == "" || bundleFor(cfg, pod) != "" || policyConfigMap(cfg, pod) != "":
+		return "", fmt.Errorf("%s only applies to CA secrets; ignoring it", keyLabel)
+	case source == "issuer" || source == "inline" || ns != pod.Namespace:
+		return "", fmt.Errorf("%s only applies to secrets in the pod's namespace; using ca.crt", keyLabel)
+	case wantsDir(pod) || !env && (wantsJava(pod) || wantsKubeRoot(pod)):
+		return "", fmt.Errorf("%s does not apply to certificate directories, Java truststores or kube-root bundles; using ca.crt", keyLabel)
+	}
+	return key, nil
+}
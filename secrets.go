@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// namespaceDefaultLabel on a namespace names the secret its pods asking for
+// the default CA get, in place of DEFAULT_CA_SECRET.
+var namespaceDefaultLabel = "microcumul.us/injectssl-default"
+
+// namespaceLister serves the namespace annotations looked up by secretName.
+// It is shared by the webhook and the reconciler so both resolve the same
+// secret; nil skips namespace defaults.
+var namespaceLister corelisters.NamespaceLister
+
+// secretName returns the CA secret requested by the pod. The annotation takes
+// precedence over the label of the same name, which exists so the webhook can
+// be scoped with an objectSelector; label values are limited to 63 characters,
+// so long secret names still need the annotation. A value of "true" stands for
+// the namespace's microcumul.us/injectssl-default, or else DEFAULT_CA_SECRET,
+// and requests nothing if neither is set. The secret may be given as
+// namespace/name if SECRET_SOURCE_NAMESPACES allows it; otherwise such a
+// reference requests nothing either. Without a secret, the pod may name a
+// cert-manager issuer instead, whose CA is copied into the namespace, or give
+// the CA itself as PEM or a URL, which is written to a secret of its own.
+func secretName(cfg *viper.Viper, pod corev1.Pod) string {
+	name, _ := resolveSecret(cfg, pod)
+	return name
+}
+
+// resolveSecret returns secretName along with where the name came from: pod,
+// owner, namespace, cluster, policy, issuer or inline.
+func resolveSecret(cfg *viper.Viper, pod corev1.Pod) (string, string) {
+	name, source := requestedSecret(pod), "pod"
+	if name != "" && podSecret(pod) == "" {
+		source = "owner"
+	}
+	if optedOut(pod) {
+		return "", ""
+	}
+	if name == "" && issuerFor(cfg, pod) == "" {
+		if n := inlineSecretName(pod); n != "" {
+			return n, "inline"
+		}
+	}
+	if name == "true" {
+		name, source = defaultSecret(cfg, pod.Namespace)
+	}
+	if p := policyFor(cfg, pod); p != nil {
+		name, source = p.spec.SecretName, "policy"
+	}
+	if iss := issuerFor(cfg, pod); iss != "" {
+		return issuerSecretName(iss), "issuer"
+	}
+	if ns, _ := splitSecretRef(pod.Namespace, name); ns != pod.Namespace && !sourceAllowed(cfg, ns) {
+		return "", ""
+	}
+	if (source == "pod" || source == "owner") && !secretNameAllowed(cfg, name) {
+		return "", ""
+	}
+	return name, source
+}
+
+// secretNamePattern caches the compiled SECRET_NAME_PATTERN.
+var secretNamePattern struct {
+	sync.Mutex
+	src string
+	re  *regexp.Regexp
+}
+
+// secretNameAllowed reports whether SECRET_NAME_PATTERN, if set, matches the
+// name of the referenced secret. Only names pods pick themselves are checked;
+// namespace and cluster defaults, policies and issuers are up to whoever
+// configures them.
+func secretNameAllowed(cfg *viper.Viper, ref string) bool {
+	src := cfg.GetString("secret.name.pattern")
+	if src == "" {
+		return true
+	}
+	secretNamePattern.Lock()
+	defer secretNamePattern.Unlock()
+	if secretNamePattern.re == nil || secretNamePattern.src != src {
+		re, err := regexp.Compile(src)
+		if err != nil {
+			lg.WithError(err).Error("invalid SECRET_NAME_PATTERN; no secret names are allowed")
+			return false
+		}
+		secretNamePattern.src, secretNamePattern.re = src, re
+	}
+	_, name := splitSecretRef("", ref)
+	return secretNamePattern.re.MatchString(name)
+}
+
+// disallowedSecret returns the secret the pod names itself if
+// SECRET_NAME_PATTERN rejects it, or the empty string.
+func disallowedSecret(cfg *viper.Viper, pod corev1.Pod) string {
+	ref := requestedSecret(pod)
+	if ref == "" || ref == "true" || optedOut(pod) || secretNameAllowed(cfg, ref) {
+		return ""
+	}
+	return ref
+}
+
+// defaultSecret returns the secret for pods of the namespace asking for the
+// default CA, and whether it is the namespace's or the cluster's.
+func defaultSecret(cfg *viper.Viper, namespace string) (string, string) {
+	if namespaceLister != nil {
+		ns, err := namespaceLister.Get(namespace)
+		if err != nil && !apierrors.IsNotFound(err) {
+			lg.WithError(err).WithField("namespace", namespace).Warn("could not get namespace for its default CA secret")
+		}
+		if err == nil && annotation(ns.Annotations, namespaceDefaultLabel) != "" {
+			return annotation(ns.Annotations, namespaceDefaultLabel), "namespace"
+		}
+	}
+	if name := cfg.GetString("default.ca.secret"); name != "" {
+		return name, "cluster"
+	}
+	return "", ""
+}
+
+// enqueueNamespace queues the pods of a namespace whose default CA secret
+// changed.
+func (r *reconciler) enqueueNamespace(old, obj interface{}) {
+	prev, ok1 := old.(*corev1.Namespace)
+	ns, ok2 := obj.(*corev1.Namespace)
+	if !ok1 || !ok2 || annotation(prev.Annotations, namespaceDefaultLabel) == annotation(ns.Annotations, namespaceDefaultLabel) || !r.namespaces.allowed(ns.Name) {
+		return
+	}
+	pods, err := r.podLister(ns.Name).Pods(ns.Name).List(labels.Everything())
+	if err != nil {
+		lg.WithError(err).Error("could not list cached pods")
+		return
+	}
+	for _, pod := range pods {
+		r.enqueue(pod)
+	}
+}
+
+// optedOut reports whether the pod declines the CA, e.g. one a policy would
+// otherwise select.
+func optedOut(pod corev1.Pod) bool {
+	return requestedSecret(pod) == "false"
+}
+
+// requestedSecret returns the raw annotation or label value, or with
+// OWNER_LOOKUP that of the workload the pod belongs to.
+func requestedSecret(pod corev1.Pod) string {
+	return first(podSecret(pod), inheritedSecret(pod))
+}
+
+// podSecret returns the raw annotation or label value of the pod itself.
+func podSecret(pod corev1.Pod) string {
+	return first(annotation(pod.Annotations, label), annotation(pod.Labels, label))
+}
+
+// checkSecret verifies, against the informer cache, that the named secret
+// exists in the namespace and carries the key, or ca.crt if it is empty.
+func checkSecret(sl corelisters.SecretLister, namespace, name, key string) error {
+	key = first(key, "ca.crt")
+	secret, err := sl.Secrets(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return fmt.Errorf("secret %q not found in namespace %q", name, namespace)
+	}
+	if err != nil {
+		return fmt.Errorf("error looking up secret %q in namespace %q: %w", name, namespace, err)
+	}
+	if _, ok := secret.Data[key]; !ok {
+		return fmt.Errorf("secret %q in namespace %q has no %q key", name, namespace, key)
+	}
+	return nil
+}
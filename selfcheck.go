@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+	admv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// selfCheckFailing is set while the last self-check failed, failing /readyz.
+var selfCheckFailing int32
+
+// selfChecker calls the injector's own webhook the way the API server would:
+// over TLS, trusting only the caBundle of the webhook configuration, with an
+// AdmissionReview for a pod.
+type selfChecker struct {
+	cs  kubernetes.Interface
+	cfg *viper.Viper
+	tls bool
+	// caBundle returns the CA the webhook configuration should hold; if it
+	// returns nothing, the configuration's own caBundle is used.
+	caBundle func() []byte
+}
+
+// run checks shortly after startup and then every SELFCHECK_INTERVAL until
+// ctx is cancelled.
+func (sc *selfChecker) run(ctx context.Context) {
+	wait := time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		cfgMu.RLock()
+		wait = sc.cfg.GetDuration("selfcheck.interval")
+		cfgMu.RUnlock()
+
+		if err := sc.check(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			lg.WithError(err).Error("self-check of the webhook failed; reporting not ready")
+			ctrSelfCheckFailures.Inc()
+			atomic.StoreInt32(&selfCheckFailing, 1)
+			continue
+		}
+		if atomic.SwapInt32(&selfCheckFailing, 0) == 1 {
+			lg.Info("self-check of the webhook passed again")
+		}
+	}
+}
+
+func (sc *selfChecker) check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	// The settings are read up front, since the webhook takes cfgMu itself.
+	cfgMu.RLock()
+	var (
+		name       = sc.cfg.GetString("webhook.name")
+		serverName = sc.cfg.GetString("service.name") + "." + podNamespace(sc.cfg) + ".svc"
+		addr       = localAddr(sc.cfg.GetString("listen.addr"))
+	)
+	cfgMu.RUnlock()
+
+	client := &http.Client{}
+	scheme := "http"
+	if sc.tls {
+		ca := sc.caBundle()
+		if len(ca) == 0 {
+			var err error
+			if ca, err = sc.webhookCABundle(ctx, name); err != nil {
+				return err
+			}
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("caBundle of webhook %s holds no certificates", name)
+		}
+		client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: pool,
+				// The name the API server verifies.
+				ServerName: serverName,
+			},
+		}
+		scheme = "https"
+	}
+
+	uid := types.UID(fmt.Sprintf("ca-injector-self-check-%d", time.Now().UnixNano()))
+	body, err := json.Marshal(selfCheckReview(uid))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, scheme+"://"+addr+"/pods", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling webhook: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook answered %s", res.Status)
+	}
+
+	var out admv1.AdmissionReview
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return fmt.Errorf("error decoding webhook response: %w", err)
+	}
+	switch {
+	case out.Response == nil:
+		return fmt.Errorf("webhook response has no response")
+	case out.Response.UID != uid:
+		return fmt.Errorf("webhook response is for %q rather than %q", out.Response.UID, uid)
+	case !out.Response.Allowed:
+		return fmt.Errorf("webhook denied the self-check pod")
+	}
+	return nil
+}
+
+// webhookCABundle returns the caBundle of the mutating webhook configuration.
+func (sc *selfChecker) webhookCABundle(ctx context.Context, name string) ([]byte, error) {
+	mwc, err := sc.cs.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting mutating webhook configuration %s: %w", name, err)
+	}
+	if len(mwc.Webhooks) == 0 || len(mwc.Webhooks[0].ClientConfig.CABundle) == 0 {
+		return nil, fmt.Errorf("mutating webhook configuration %s has no caBundle", name)
+	}
+	return mwc.Webhooks[0].ClientConfig.CABundle, nil
+}
+
+// selfCheckReview is a dry-run review of a pod which asks for no CA, so the
+// check has no side effects.
+func selfCheckReview(uid types.UID) admv1.AdmissionReview {
+	dryRun := true
+	pod := corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "ca-injector-self-check",
+			Namespace: metav1.NamespaceDefault,
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "check", Image: "ca-injector-self-check"}},
+		},
+	}
+	raw, _ := json.Marshal(pod)
+	return admv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: admv1.SchemeGroupVersion.String(), Kind: "AdmissionReview"},
+		Request: &admv1.AdmissionRequest{
+			UID:       uid,
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Namespace: metav1.NamespaceDefault,
+			Operation: admv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+			DryRun:    &dryRun,
+		},
+	}
+}
+
+// localAddr turns a listen address into one to dial on this host.
+func localAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
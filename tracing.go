@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/rest"
+)
+
+// tracer records spans with the global provider, which is a no-op unless
+// setupTracing installed an exporter.
+var tracer = otel.Tracer("github.com/microcumulus/ca-injector")
+
+// setupTracing exports spans over OTLP/HTTP as configured by the standard
+// OTEL_EXPORTER_OTLP_* and OTEL_SERVICE_NAME variables. Without an endpoint
+// tracing stays a no-op. The returned function flushes pending spans.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error creating OTLP exporter: %w", err)
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceNameKey.String("ca-injector")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error creating trace resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+// traceAPICalls records Kubernetes API calls made within a span as its
+// children. Calls without one, such as the informers' lists and watches, are
+// not traced so they don't each start a trace of their own.
+func traceAPICalls(conf *rest.Config) {
+	conf.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return tracedTransport{
+			base:   rt,
+			traced: otelhttp.NewTransport(rt),
+		}
+	})
+}
+
+type tracedTransport struct {
+	base, traced http.RoundTripper
+}
+
+func (t tracedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if trace.SpanContextFromContext(r.Context()).IsValid() {
+		return t.traced.RoundTrip(r)
+	}
+	return t.base.RoundTrip(r)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+var javaLabel = "microcumul.us/injectssl-java"
+
+const (
+	truststoreSourceAnnotation = "microcumul.us/truststore-source"
+	truststoreKey              = "truststore.p12"
+	truststorePassword         = "changeit"
+)
+
+// javaToolOptions points Java at the truststore mounted at mountPath.
+func javaToolOptions(mountPath string) string {
+	return "-Djavax.net.ssl.trustStore=" + mountPath + "/" + truststoreKey + " -Djavax.net.ssl.trustStorePassword=" + truststorePassword
+}
+
+// truststoreSecretName is the name of the secret derived from a CA secret
+// which additionally contains a PKCS12 truststore for Java applications.
+func truststoreSecretName(secret string) string {
+	return secret + "-truststore"
+}
+
+// wantsJava reports whether the pod opted in to Java truststore injection,
+// or an image rule asks for it.
+func wantsJava(pod corev1.Pod) bool {
+	return annotation(pod.Annotations, javaLabel) == "true" || rulesWantJava(pod)
+}
+
+// injectedSecretName returns the name of the secret that should be mounted
+// into the pod as the injected volume.
+func injectedSecretName(cfg *viper.Viper, pod corev1.Pod) string {
+	secret := localSecretName(pod.Namespace, secretName(cfg, pod))
+	if wantsDir(pod) {
+		return certDirSecretName(secret)
+	}
+	if wantsJava(pod) {
+		return truststoreSecretName(secret)
+	}
+	return secret
+}
+
+// syncTruststore makes sure the derived truststore secret for the given CA
+// secret exists in the namespace and matches the current ca.crt. Reads are
+// served from the informer cache.
+func syncTruststore(ctx context.Context, cs kubernetes.Interface, sl corelisters.SecretLister, namespace, secret string) error {
+	src, err := sl.Secrets(namespace).Get(secret)
+	if err != nil {
+		return fmt.Errorf("error getting source secret %s/%s: %w", namespace, secret, err)
+	}
+
+	ca, ok := src.Data["ca.crt"]
+	if !ok {
+		return fmt.Errorf("source secret %s/%s has no ca.crt key", namespace, secret)
+	}
+
+	name := truststoreSecretName(secret)
+	cur, err := sl.Secrets(namespace).Get(name)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error getting truststore secret %s/%s: %w", namespace, name, err)
+	}
+	exists := err == nil
+	if exists {
+		if cur.Annotations[truststoreSourceAnnotation] != secret {
+			return fmt.Errorf("secret %s/%s exists and is not managed by ca-injector", namespace, name)
+		}
+		if bytes.Equal(cur.Data["ca.crt"], ca) && len(cur.Data[truststoreKey]) > 0 {
+			return nil
+		}
+	}
+
+	p12, err := buildTruststore(ca)
+	if err != nil {
+		return fmt.Errorf("error building truststore for %s/%s: %w", namespace, secret, err)
+	}
+
+	data := map[string][]byte{
+		"ca.crt":      ca,
+		truststoreKey: p12,
+	}
+
+	if !exists {
+		_, err = cs.CoreV1().Secrets(namespace).Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Labels: map[string]string{
+					"app.kubernetes.io/managed-by": "ca-injector",
+				},
+				Annotations: map[string]string{
+					truststoreSourceAnnotation: secret,
+				},
+			},
+			Data: data,
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("error creating truststore secret %s/%s: %w", namespace, name, err)
+		}
+		return nil
+	}
+
+	cur = cur.DeepCopy()
+	cur.Data = data
+	_, err = cs.CoreV1().Secrets(namespace).Update(ctx, cur, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("error updating truststore secret %s/%s: %w", namespace, name, err)
+	}
+	return nil
+}
+
+// buildTruststore encodes every certificate in the PEM bundle into a PKCS12
+// truststore usable by Java 8 and newer.
+func buildTruststore(ca []byte) ([]byte, error) {
+	var entries []pkcs12.TrustStoreEntry
+	for {
+		var blk *pem.Block
+		blk, ca = pem.Decode(ca)
+		if blk == nil {
+			break
+		}
+		if blk.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(blk.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing cert in bundle: %w", err)
+		}
+		entries = append(entries, pkcs12.TrustStoreEntry{
+			Cert:         cert,
+			FriendlyName: fmt.Sprintf("ca-injector-%d", len(entries)),
+		})
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no certificates found in ca.crt")
+	}
+	return pkcs12.EncodeTrustStoreEntries(rand.Reader, entries, truststorePassword)
+}
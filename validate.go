@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	admv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// validatePods returns the handler for /validate, served to a
+// ValidatingWebhookConfiguration: it denies pods whose CA cannot be injected,
+// or with VALIDATE_POLICY=warn, only warns about them. It never writes
+// anything, so dry-run requests get the same answer. issuers and bundles may
+// be nil.
+func validatePods(cfg *viper.Viper, secrets corelisters.SecretLister, issuers *issuerResolver, bundles *bundleResolver, ownNs string) admitFunc {
+	return func(ctx context.Context, ar admv1.AdmissionReview) (*admv1.AdmissionResponse, error) {
+		cfg := settings(cfg)
+		allowed := &admv1.AdmissionResponse{Allowed: true}
+		if k := ar.Request.Kind; k.Group != "" || k.Kind != "Pod" {
+			setReason(ctx, "unsupported_kind", true)
+			return allowed, nil
+		}
+		if ar.Request.Operation != admv1.Create || ar.Request.SubResource != "" {
+			setReason(ctx, "unsupported_operation", true)
+			return allowed, nil
+		}
+		if namespaceExcluded(cfg, ownNs, ar.Request.Namespace) {
+			setReason(ctx, "excluded_namespace", true)
+			return allowed, nil
+		}
+
+		var pod corev1.Pod
+		if _, _, err := codecs.UniversalDeserializer().Decode(ar.Request.Object.Raw, nil, &pod); err != nil {
+			ctrDecodeErrors.WithLabelValues("object").Inc()
+			return nil, err
+		}
+		if pod.Namespace == "" {
+			pod.Namespace = ar.Request.Namespace
+		}
+
+		problems := caProblems(ctx, cfg, secrets, issuers, bundles, pod)
+		if len(problems) == 0 {
+			return allowed, nil
+		}
+		requestLogger(ctx).WithFields(logrus.Fields{
+			"pod.Name":      first(pod.Name, pod.GenerateName),
+			"pod.Namespace": pod.Namespace,
+			"problems":      problems,
+		}).Info("pod's CA cannot be injected")
+		setReason(ctx, "secret_missing", false)
+		if cfg.GetString("validate.policy") == "warn" || optional(cfg, pod) {
+			allowed.Warnings = capWarnings(problems)
+			return allowed, nil
+		}
+		return &admv1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Reason:  metav1.StatusReasonInvalid,
+				Code:    http.StatusUnprocessableEntity,
+				Message: "ca-injector: " + strings.Join(problems, "; "),
+			},
+		}, nil
+	}
+}
+
+// caProblems returns why the CA the pod asks for cannot be injected, if it
+// asks for one.
+func caProblems(ctx context.Context, cfg *viper.Viper, secrets corelisters.SecretLister, issuers *issuerResolver, bundles *bundleResolver, pod corev1.Pod) []string {
+	secret := secretName(cfg, pod)
+	bundle := bundleFor(cfg, pod)
+	cm := policyConfigMap(cfg, pod)
+	if secret == "" && bundle == "" && cm == "" {
+		switch ref := requestedSecret(pod); {
+		case optedOut(pod):
+		case disallowedSecret(cfg, pod) != "":
+			return []string{fmt.Sprintf("ca-injector may not inject secret %q, which does not match SECRET_NAME_PATTERN", ref)}
+		case ref == "true":
+			return []string{"ca-injector has no default CA secret configured for this namespace"}
+		case ref != "":
+			return []string{fmt.Sprintf("ca-injector may not copy secret %q into this namespace", ref)}
+		}
+		return nil
+	}
+
+	var err error
+	switch {
+	case cm != "":
+		err = policies.checkConfigMap(pod.Namespace, policyFor(cfg, pod))
+	case bundle != "":
+		err = bundles.check(pod.Namespace, bundle)
+	case issuerFor(cfg, pod) != "":
+		_, _, err = issuers.check(pod.Namespace, issuerFor(cfg, pod))
+	case usesInline(secret, pod):
+		// A URL is only fetched once a pod asking for it exists.
+		if _, err = inlineCA(cfg, secrets, pod); errors.Is(err, errInlineNotFetched) {
+			err = nil
+		}
+	default:
+		srcNs, srcName := splitSecretRef(pod.Namespace, secret)
+		if errs := validation.IsDNS1123Subdomain(srcName); len(errs) > 0 {
+			return []string{fmt.Sprintf("%q is not a valid secret name: %s", srcName, strings.Join(errs, "; "))}
+		}
+		key, _ := secretKey(cfg, pod)
+		err = checkSecret(secrets, srcNs, srcName, key)
+	}
+	if err != nil {
+		return []string{err.Error()}
+	}
+	return nil
+}
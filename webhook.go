@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	admregv1 "k8s.io/api/admissionregistration/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// webhookManager keeps the MutatingWebhookConfiguration for the injector as
+// configured, reverting any edits.
+type webhookManager struct {
+	cs      kubernetes.Interface
+	cfg     *viper.Viper
+	name    string
+	factory informers.SharedInformerFactory
+
+	// caBundle returns the CA to put in the configuration; if it returns
+	// nothing, the current caBundle is kept, e.g. for cert-manager's
+	// cainjector to fill in.
+	caBundle func() []byte
+
+	trigger chan struct{}
+}
+
+// newWebhookManager registers an informer for just the named configuration
+// with a new factory, which is started by run.
+func newWebhookManager(cs kubernetes.Interface, cfg *viper.Viper, caBundle func() []byte) *webhookManager {
+	w := &webhookManager{
+		cs:       cs,
+		cfg:      cfg,
+		name:     cfg.GetString("webhook.name"),
+		caBundle: caBundle,
+		trigger:  make(chan struct{}, 1),
+	}
+	w.factory = informers.NewSharedInformerFactoryWithOptions(cs, 10*time.Minute, informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+		o.FieldSelector = "metadata.name=" + w.name
+	}))
+	w.factory.Admissionregistration().V1().MutatingWebhookConfigurations().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { w.poke() },
+		UpdateFunc: func(_, _ interface{}) { w.poke() },
+		DeleteFunc: func(interface{}) { w.poke() },
+	})
+	return w
+}
+
+func (w *webhookManager) poke() {
+	select {
+	case w.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// run syncs the configuration whenever it changes until ctx is cancelled.
+func (w *webhookManager) run(ctx context.Context) {
+	w.factory.Start(ctx.Done())
+	w.poke()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.trigger:
+		}
+		if err := w.sync(ctx); err != nil {
+			lg.WithError(err).WithField("webhook", w.name).Error("could not sync mutating webhook configuration")
+			go func() {
+				time.Sleep(10 * time.Second)
+				w.poke()
+			}()
+		}
+	}
+}
+
+func (w *webhookManager) sync(ctx context.Context) error {
+	mwcs := w.cs.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	cur, err := mwcs.Get(ctx, w.name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error getting mutating webhook configuration: %w", err)
+	}
+
+	desired := w.desired()
+	ca := w.caBundle()
+	if len(ca) == 0 && err == nil && len(cur.Webhooks) > 0 {
+		ca = cur.Webhooks[0].ClientConfig.CABundle
+	}
+	for i := range desired {
+		desired[i].ClientConfig.CABundle = ca
+	}
+
+	if apierrors.IsNotFound(err) {
+		_, err := mwcs.Create(ctx, &admregv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: w.name,
+				Labels: map[string]string{
+					"app.kubernetes.io/managed-by": "ca-injector",
+				},
+			},
+			Webhooks: desired,
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("error creating mutating webhook configuration: %w", err)
+		}
+		lg.WithField("webhook", w.name).Info("created mutating webhook configuration")
+		return nil
+	}
+
+	if reflect.DeepEqual(cur.Webhooks, desired) {
+		return nil
+	}
+	cur = cur.DeepCopy()
+	cur.Webhooks = desired
+	if _, err := mwcs.Update(ctx, cur, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("error updating mutating webhook configuration: %w", err)
+	}
+	lg.WithField("webhook", w.name).Info("reverted mutating webhook configuration to the injector's settings")
+	return nil
+}
+
+// desired returns the webhook as configured, with every defaulted field set
+// so it compares equal to what the API server returns.
+func (w *webhookManager) desired() []admregv1.MutatingWebhook {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	var (
+		scope        = admregv1.NamespacedScope
+		failure      = admregv1.FailurePolicyType(w.cfg.GetString("webhook.failure.policy"))
+		reinvocation = admregv1.ReinvocationPolicyType(w.cfg.GetString("webhook.reinvocation.policy"))
+		sideEffects  = admregv1.SideEffectClassNoneOnDryRun
+		match        = admregv1.Equivalent
+		timeout      = int32(w.cfg.GetDuration("webhook.timeout") / time.Second)
+		port         = int32(443)
+		podsPath     = "/pods"
+		loadsPath    = "/workloads"
+	)
+
+	// Never intercept our own pods, so the injector can always be scheduled,
+	// nor those of excluded namespaces. Patterns cannot be expressed as a
+	// selector; the handler still skips them. Namespaces only the reconciler
+	// excludes are still mutated.
+	var excluded []string
+	if ns := podNamespace(w.cfg); ns != "" {
+		excluded = append(excluded, ns)
+	}
+	for _, ns := range splitList(w.cfg.GetString("exclude.namespaces")) {
+		if !strings.ContainsAny(ns, `*?[\`) {
+			excluded = append(excluded, ns)
+		}
+	}
+
+	objectSelector := &metav1.LabelSelector{}
+	if w.cfg.GetBool("webhook.label.selector") {
+		objectSelector.MatchExpressions = []metav1.LabelSelectorRequirement{{
+			Key:      label,
+			Operator: metav1.LabelSelectorOpExists,
+		}}
+	}
+
+	hooks := []admregv1.MutatingWebhook{{
+		Name:                    w.name,
+		AdmissionReviewVersions: []string{"v1", "v1beta1"},
+		SideEffects:             &sideEffects,
+		FailurePolicy:           &failure,
+		ReinvocationPolicy:      &reinvocation,
+		MatchPolicy:             &match,
+		TimeoutSeconds:          &timeout,
+		Rules: []admregv1.RuleWithOperations{{
+			Operations: []admregv1.OperationType{admregv1.Create},
+			Rule: admregv1.Rule{
+				APIGroups:   []string{""},
+				APIVersions: []string{"v1"},
+				Resources:   []string{"pods"},
+				Scope:       &scope,
+			},
+		}},
+		NamespaceSelector: &metav1.LabelSelector{
+			MatchExpressions: []metav1.LabelSelectorRequirement{{
+				Key:      "kubernetes.io/metadata.name",
+				Operator: metav1.LabelSelectorOpNotIn,
+				Values:   excluded,
+			}},
+		},
+		ObjectSelector: objectSelector,
+		ClientConfig: admregv1.WebhookClientConfig{
+			Service: &admregv1.ServiceReference{
+				Namespace: podNamespace(w.cfg),
+				Name:      w.cfg.GetString("service.name"),
+				Path:      &podsPath,
+				Port:      &port,
+			},
+		},
+	}}
+	if !w.cfg.GetBool("webhook.workloads") {
+		return hooks
+	}
+
+	// Workloads are not labelled like their pods, so they are all sent.
+	loads := *hooks[0].DeepCopy()
+	loads.Name = "workloads." + w.name
+	loads.ObjectSelector = &metav1.LabelSelector{}
+	loads.ClientConfig.Service.Path = &loadsPath
+	loads.Rules = []admregv1.RuleWithOperations{{
+		Operations: []admregv1.OperationType{admregv1.Create, admregv1.Update},
+		Rule: admregv1.Rule{
+			APIGroups:   []string{"apps"},
+			APIVersions: []string{"v1"},
+			Resources:   []string{"deployments", "statefulsets", "daemonsets"},
+			Scope:       &scope,
+		},
+	}, {
+		Operations: []admregv1.OperationType{admregv1.Create, admregv1.Update},
+		Rule: admregv1.Rule{
+			APIGroups:   []string{"batch"},
+			APIVersions: []string{"v1"},
+			Resources:   []string{"cronjobs"},
+			Scope:       &scope,
+		},
+	}}
+	return append(hooks, loads)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// osLabel is the node label and, by convention, the taint key telling Windows
+// nodes apart.
+const osLabel = "kubernetes.io/os"
+
+// windowsPod reports whether the pod runs on Windows nodes, going by its OS,
+// node selector, required node affinity or tolerations.
+func windowsPod(pod corev1.Pod) bool {
+	if pod.Spec.OS != nil {
+		return pod.Spec.OS.Name == corev1.Windows
+	}
+	if os, ok := pod.Spec.NodeSelector[osLabel]; ok {
+		return os == string(corev1.Windows)
+	}
+	if a := pod.Spec.Affinity; a != nil && a.NodeAffinity != nil && a.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil {
+		for _, term := range a.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+			for _, expr := range term.MatchExpressions {
+				if expr.Key == osLabel && expr.Operator == corev1.NodeSelectorOpIn && len(expr.Values) == 1 && expr.Values[0] == string(corev1.Windows) {
+					return true
+				}
+			}
+		}
+	}
+	for _, t := range pod.Spec.Tolerations {
+		if (t.Key == "os" || t.Key == osLabel) && t.Value == string(corev1.Windows) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipsWindows reports whether the pod is left alone for running on Windows,
+// which the Linux paths the CA is injected at do not work on unless
+// WINDOWS_POLICY=inject.
+func skipsWindows(cfg *viper.Viper, pod corev1.Pod) bool {
+	return cfg.GetString("windows.policy") != "inject" && windowsPod(pod)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/microcumulus/ca-injector/mutate"
+	admv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// workloadTemplate returns the metadata of the workload in raw and its pod
+// template, with the JSON pointer of the template. It reports false for kinds
+// which are not handled.
+func workloadTemplate(kind metav1.GroupVersionKind, raw []byte) (metav1.ObjectMeta, corev1.PodTemplateSpec, string, bool, error) {
+	var (
+		meta metav1.ObjectMeta
+		tmpl corev1.PodTemplateSpec
+		root = "/spec/template"
+		err  error
+	)
+	switch kind.Group + "/" + kind.Kind {
+	case "apps/Deployment":
+		var obj appsv1.Deployment
+		err = json.Unmarshal(raw, &obj)
+		meta, tmpl = obj.ObjectMeta, obj.Spec.Template
+	case "apps/StatefulSet":
+		var obj appsv1.StatefulSet
+		err = json.Unmarshal(raw, &obj)
+		meta, tmpl = obj.ObjectMeta, obj.Spec.Template
+	case "apps/DaemonSet":
+		var obj appsv1.DaemonSet
+		err = json.Unmarshal(raw, &obj)
+		meta, tmpl = obj.ObjectMeta, obj.Spec.Template
+	case "batch/CronJob":
+		var obj batchv1.CronJob
+		err = json.Unmarshal(raw, &obj)
+		meta, tmpl = obj.ObjectMeta, obj.Spec.JobTemplate.Spec.Template
+		root = "/spec/jobTemplate/spec/template"
+	default:
+		return meta, tmpl, "", false, nil
+	}
+	return meta, tmpl, root, true, err
+}
+
+// admitWorkloads injects the CA into the pod templates of workloads rather
+// than their pods, so it shows up in diffs and rolls the workload out when it
+// changes. The template is handed to admitPod as a pod being created, and the
+// resulting patch moved to the template; pods made from it are then left
+// alone.
+func admitWorkloads(admitPod admitFunc) admitFunc {
+	return func(ctx context.Context, ar admv1.AdmissionReview) (*admv1.AdmissionResponse, error) {
+		lg := requestLogger(ctx)
+		switch {
+		case ar.Request.SubResource != "":
+		case ar.Request.Operation == admv1.Create || ar.Request.Operation == admv1.Update:
+		default:
+			setReason(ctx, "unsupported_operation", true)
+			return &admv1.AdmissionResponse{Allowed: true}, nil
+		}
+
+		meta, tmpl, root, ok, err := workloadTemplate(ar.Request.Kind, ar.Request.Object.Raw)
+		if !ok {
+			lg.WithField("kind", ar.Request.Kind.String()).Warn("allowing unsupported kind; check the webhook rules")
+			setReason(ctx, "unsupported_kind", true)
+			return &admv1.AdmissionResponse{Allowed: true}, nil
+		}
+		if err != nil {
+			ctrDecodeErrors.WithLabelValues("object").Inc()
+			lg.WithError(err).Error("could not deserialize workload")
+			return nil, err
+		}
+
+		pod := corev1.Pod{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: tmpl.ObjectMeta,
+			Spec:       tmpl.Spec,
+		}
+		// Named after the workload, for logs and metrics.
+		pod.Name, pod.GenerateName = meta.Name, ""
+		pod.Namespace = ar.Request.Namespace
+		delete(pod.Annotations, mutate.InjectedTemplateAnnotation)
+		raw, err := json.Marshal(pod)
+		if err != nil {
+			return nil, err
+		}
+
+		req := ar.Request.DeepCopy()
+		req.Kind = metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}
+		req.Resource = metav1.GroupVersionResource{Version: "v1", Resource: "pods"}
+		req.Operation = admv1.Create
+		req.Object.Raw, req.Object.Object = raw, nil
+		req.OldObject.Raw, req.OldObject.Object = nil, nil
+		ctx = withLogger(ctx, lg.WithField("workload", fmt.Sprintf("%s/%s", ar.Request.Kind.Kind, meta.Name)))
+		res, err := admitPod(ctx, admv1.AdmissionReview{TypeMeta: ar.TypeMeta, Request: req})
+		if err != nil || res == nil || emptyPatch(res.Patch) {
+			return res, err
+		}
+
+		var patch []mutate.PatchOp
+		if err := json.Unmarshal(res.Patch, &patch); err != nil {
+			return nil, fmt.Errorf("error decoding pod patch: %w", err)
+		}
+		if res.Patch, err = json.Marshal(mutate.TemplatePatch(patch, root)); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+}